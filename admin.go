@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+var adminLog = logging.New("admin")
+
+// targetStatus is how a polled host is shown by the admin server
+type targetStatus struct {
+	Target      string            `json:"target"`
+	Source      string            `json:"source"`
+	Labels      map[string]string `json:"labels"`
+	Health      string            `json:"health"`
+	LastPoll    *time.Time        `json:"last_poll,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	Failures    int               `json:"failures"`
+	ParseErrors int               `json:"parse_errors"`
+}
+
+// aggregate is a datapoint about to be pushed, as shown by the admin server
+type aggregate struct {
+	Name       string             `json:"name"`
+	Dimensions map[string]string  `json:"dimensions"`
+	Unit       string             `json:"unit"`
+	Value      *float64           `json:"value,omitempty"`
+	Statistics map[string]float64 `json:"statistics,omitempty"`
+	Values     []float64          `json:"values,omitempty"`
+	Counts     []float64          `json:"counts,omitempty"`
+}
+
+// startAdmin starts the admin http server if an address is configured
+func startAdmin() {
+	if cfg.Admin.Listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/targets", handleTargets)
+	mux.HandleFunc("/targets/", handleTarget)
+	mux.HandleFunc("/aggregates", handleAggregates)
+	mux.HandleFunc("/discovery/refresh", handleRediscover)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/log/levels", handleLogLevels)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	go func() {
+		adminLog.Infof("admin server listening on %s", cfg.Admin.Listen)
+		err := http.ListenAndServe(cfg.Admin.Listen, authorize(mux))
+		if err != nil {
+			adminLog.Errorf("admin server stopped: %s", err)
+		}
+	}()
+}
+
+// authorize only lets through the requests changing the state of the poller
+// that carry the configured token as a bearer token, reads are always
+// allowed
+func authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		stateLock.RLock()
+		token := cfg.Admin.Token
+		stateLock.RUnlock()
+		auth := []byte(r.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			adminLog.Warnf("rejecting unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		adminLog.Warnf("error writing admin response: %s", err)
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// findPoller returns the poller of a host
+func findPoller(target string) *uwsgi.UwsgiPoller {
+	for _, p := range uwsgiScheduler.Pollers() {
+		if p.Target == target {
+			return p
+		}
+	}
+	return nil
+}
+
+// handleTargets lists the polled hosts with the etcd directory they were
+// discovered in and the state of their poller
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	pollers := uwsgiScheduler.Pollers()
+	targets := make([]*targetStatus, 0, len(pollers))
+	for _, p := range pollers {
+		status := p.Status()
+		t := &targetStatus{
+			Target:      status.Target,
+			Source:      status.Labels["etcd_dir"],
+			Labels:      status.Labels,
+			Health:      uwsgi.HealthName(status.Health),
+			Failures:    status.Failures,
+			ParseErrors: status.ParseErrors,
+		}
+		if !status.LastPoll.IsZero() {
+			t.LastPoll = &status.LastPoll
+		}
+		if status.LastError != nil {
+			t.LastError = status.LastError.Error()
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Target < targets[j].Target
+	})
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// handleTarget serves /targets/<host>/stats, the last stats of a host,
+// /targets/<host>/bad-payload, the beginning of its last response that
+// failed to parse, and /targets/<host>/poll, which polls it right away
+func handleTarget(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/targets/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	target, action := path[:i], path[i+1:]
+	p := findPoller(target)
+	if p == nil {
+		http.Error(w, "unknown target "+target, http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "stats":
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		stats := p.LastStats()
+		if stats == nil {
+			http.Error(w, "no stats for "+target+" yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	case "bad-payload":
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		payload := p.LastBadPayload()
+		if payload == nil {
+			http.Error(w, "no bad payload for "+target, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(payload)
+	case "poll":
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		if !uwsgiScheduler.PollNow(target) {
+			http.Error(w, target+" is already being polled", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAggregates returns, for every aggregation group, the datapoints that
+// would be pushed if the pending round was closed now
+func handleAggregates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	round := uwsgiScheduler.PendingRound()
+	groups := make(map[string][]*aggregate)
+	stateLock.RLock()
+	for name, pusher := range pushers {
+		data := pusher.Preview(groupRound(round, name))
+		aggregates := make([]*aggregate, 0, len(data))
+		for _, datum := range data {
+			aggregates = append(aggregates, newAggregate(datum))
+		}
+		groups[name] = aggregates
+	}
+	stateLock.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"round":  round,
+		"groups": groups,
+	})
+}
+
+func newAggregate(datum *cloudwatch.MetricDatum) *aggregate {
+	a := &aggregate{
+		Name:       *datum.MetricName,
+		Dimensions: make(map[string]string),
+		Value:      datum.Value,
+	}
+	if datum.Unit != nil {
+		a.Unit = *datum.Unit
+	}
+	for _, d := range datum.Dimensions {
+		a.Dimensions[*d.Name] = *d.Value
+	}
+	if s := datum.StatisticValues; s != nil {
+		a.Statistics = map[string]float64{
+			"sample_count": *s.SampleCount,
+			"sum":          *s.Sum,
+			"minimum":      *s.Minimum,
+			"maximum":      *s.Maximum,
+		}
+	}
+	for _, v := range datum.Values {
+		a.Values = append(a.Values, *v)
+	}
+	for _, c := range datum.Counts {
+		a.Counts = append(a.Counts, *c)
+	}
+	return a
+}
+
+// handleRediscover makes every etcd watcher read its directory right away
+func handleRediscover(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	select {
+	case rediscoverChan <- 1:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// logLevels are the log levels as shown by the admin server
+type logLevels struct {
+	Default    string            `json:"default"`
+	Components map[string]string `json:"components"`
+}
+
+func currentLogLevels() *logLevels {
+	level, components := logging.Levels()
+	levels := &logLevels{
+		Default:    logging.LevelName(level),
+		Components: make(map[string]string, len(components)),
+	}
+	for component, level := range components {
+		levels.Components[component] = logging.LevelName(level)
+	}
+	return levels
+}
+
+// handleLogLevels returns the log levels on GET, sets the level of a
+// component, or the default one when no component is given, on POST and
+// makes a component use the default level again on DELETE. the levels set
+// here are reset when the configuration is reloaded
+func handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	component := r.FormValue("component")
+	if component != "" {
+		known := false
+		for _, c := range logging.Components() {
+			known = known || c == component
+		}
+		if !known {
+			http.Error(w, "unknown component "+component, http.StatusNotFound)
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		level, err := logging.LevelFromString(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if component == "" {
+			logging.SetDefaultLevel(level)
+			adminLog.Infof("default log level set to %s", logging.LevelName(level))
+		} else {
+			logging.SetLevel(component, level)
+			adminLog.Infof("log level of %s set to %s", component, logging.LevelName(level))
+		}
+	case "DELETE":
+		if component == "" {
+			http.Error(w, "no component given", http.StatusBadRequest)
+			return
+		}
+		logging.ResetLevel(component)
+		adminLog.Infof("log level of %s reset to the default", component)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, currentLogLevels())
+}
@@ -0,0 +1,125 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// how the values of the single hosts are combined into the group value
+const (
+	AGGREGATE_SUM = iota
+	AGGREGATE_WEIGHTED_MEAN
+)
+
+// statistics of the single host values that can be pushed along with the
+// group value
+const (
+	STATISTIC_MIN = iota
+	STATISTIC_MAX
+	STATISTIC_AVERAGE
+)
+
+var (
+	statistics = map[string]int{
+		"min":     STATISTIC_MIN,
+		"max":     STATISTIC_MAX,
+		"average": STATISTIC_AVERAGE,
+	}
+
+	// StatisticNames lists the accepted names of the host statistics
+	StatisticNames = []string{"min", "max", "average"}
+)
+
+func StatisticFromString(name string) (int, error) {
+	statistic, ok := statistics[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown statistic %s, must be one of %s", name, strings.Join(StatisticNames, ","))
+	}
+	return statistic, nil
+}
+
+func statisticName(statistic int) string {
+	for name, s := range statistics {
+		if s == statistic {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// metric describes a value known for every host and how it is aggregated
+// across the group: counts are summed, percentages are averaged weighting
+// each host by the workers its percentage is computed on
+type metric struct {
+	name        string
+	unit        string
+	aggregation int
+	value       func(h *hostState) float64
+	weight      func(h *hostState) float64
+}
+
+func activeWorkers(h *hostState) float64 { return h.activeWorkers }
+
+var hostMetrics = []*metric{
+	{"total-workers", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.totalWorkers }, nil},
+	{"active-workers", "Count", AGGREGATE_SUM, activeWorkers, nil},
+	{"idle-workers", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.idleWorkers }, nil},
+	{"busy-workers", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.busyWorkers }, nil},
+	{"exceptions-count", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.exceptionsCount }, nil},
+	{"busy-workers-percentage", "Percent", AGGREGATE_WEIGHTED_MEAN, func(h *hostState) float64 { return h.busyWorkersPercentage }, activeWorkers},
+	{"idle-workers-percentage", "Percent", AGGREGATE_WEIGHTED_MEAN, func(h *hostState) float64 { return h.idleWorkersPercentage }, activeWorkers},
+	{"harakiri-count", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.harakiriCount }, nil},
+	{"respawn-count", "Count", AGGREGATE_SUM, func(h *hostState) float64 { return h.respawnCount }, nil},
+}
+
+// aggregate returns the group value of the metric. a weighted mean ignores
+// the hosts with no weight, e.g. the ones with no active worker, so that
+// they do not drag the percentage down
+func (m *metric) aggregate(snap *snapshot) float64 {
+	if m.aggregation == AGGREGATE_SUM {
+		return snap.sum(m.value)
+	}
+	var total, weights float64
+	for _, h := range snap.hosts {
+		weight := m.weight(h)
+		total += m.value(h) * weight
+		weights += weight
+	}
+	if weights == 0 {
+		return 0.0
+	}
+	return total / weights
+}
+
+// values returns the value of the metric for every host of the snapshot. a
+// zeroed host only counts as zero in the sums, it has no percentage and is
+// left out of the values of a weighted mean as it is out of the mean itself
+func (m *metric) values(snap *snapshot) []float64 {
+	values := make([]float64, 0, len(snap.hosts))
+	for _, h := range snap.hosts {
+		if h.zero && m.aggregation == AGGREGATE_WEIGHTED_MEAN {
+			continue
+		}
+		values = append(values, m.value(h))
+	}
+	return values
+}
+
+// statistic computes a statistic of a non empty set of values
+func statistic(values []float64, statistic int) float64 {
+	result := values[0]
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+		switch {
+		case statistic == STATISTIC_MIN && v < result:
+			result = v
+		case statistic == STATISTIC_MAX && v > result:
+			result = v
+		}
+	}
+	if statistic == STATISTIC_AVERAGE {
+		return sum / float64(len(values))
+	}
+	return result
+}
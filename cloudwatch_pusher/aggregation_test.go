@@ -0,0 +1,45 @@
+package cloudwatch_pusher
+
+import (
+	"testing"
+)
+
+func hostMetric(t *testing.T, name string) *metric {
+	for _, m := range hostMetrics {
+		if m.name == name {
+			return m
+		}
+	}
+	t.Fatalf("no metric %s", name)
+	return nil
+}
+
+func TestZeroedHostOutOfPercentages(t *testing.T) {
+	up := &hostState{
+		target:                "up",
+		totalWorkers:          4,
+		activeWorkers:         4,
+		busyWorkersPercentage: 50,
+	}
+	snap := &snapshot{
+		hosts: map[string]*hostState{
+			"up":    up,
+			"stale": up.zeroed(),
+		},
+	}
+	busy := hostMetric(t, "busy-workers-percentage")
+	if v := busy.aggregate(snap); v != 50 {
+		t.Fatalf("expected the zeroed host to be out of the mean, got %f", v)
+	}
+	values := busy.values(snap)
+	if len(values) != 1 || values[0] != 50 {
+		t.Fatalf("expected the zeroed host to be out of the host values, got %v", values)
+	}
+	total := hostMetric(t, "total-workers")
+	if v := total.aggregate(snap); v != 4 {
+		t.Fatalf("expected the zeroed host to count as zero, got %f", v)
+	}
+	if values := total.values(snap); len(values) != 2 || statistic(values, STATISTIC_MIN) != 0 {
+		t.Fatalf("expected the zeroed host to be in the count values, got %v", values)
+	}
+}
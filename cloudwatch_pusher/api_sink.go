@@ -0,0 +1,190 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
+)
+
+const (
+	// putBatchSize is the number of datapoints sent in a single
+	// PutMetricData call
+	putBatchSize = 20
+)
+
+// apiSink pushes the datapoints with the CloudWatch PutMetricData API. the
+// datapoints that fail to be pushed are queued and retried in the background
+type apiSink struct {
+	client    cloudwatchiface.CloudWatchAPI
+	namespace string
+	log       *logging.Logger
+	queue     *retryQueue
+	backoff   u.Backoff
+	quit      chan int
+	done      chan int
+}
+
+func newAPISink(client cloudwatchiface.CloudWatchAPI, opts Options) (s *apiSink, err error) {
+	log := logger.With("group", opts.AutoscalingGroupName)
+	queue, err := newRetryQueue(opts.RetryQueuePath, opts.RetryQueueSize, opts.RetryMaxAge)
+	if err != nil {
+		log.Errorf("error loading retry queue: %s", err)
+		return nil, err
+	}
+	s = &apiSink{
+		client:    client,
+		namespace: opts.NameSpace,
+		log:       log,
+		queue:     queue,
+		backoff:   opts.RetryBackoff,
+		quit:      make(chan int),
+		done:      make(chan int),
+	}
+	err = s.checkClient()
+	if err != nil {
+		log.Errorf("error creating cloudwatch client: %s", err)
+		return nil, err
+	}
+	go s.runRetries()
+	return s, nil
+}
+
+func (s *apiSink) name() string {
+	return "api"
+}
+
+// push sends the datapoints in batches, a batch that fails to be pushed is
+// queued to be retried later with its original timestamps unless CloudWatch
+// rejected it for good
+func (s *apiSink) push(r *u.Round, snap *snapshot, data []*cloudwatch.MetricDatum) (err error) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > putBatchSize {
+			n = putBatchSize
+		}
+		params := &cloudwatch.PutMetricDataInput{
+			MetricData: data[:n],
+			Namespace:  aws.String(s.namespace),
+		}
+		_, perr := s.client.PutMetricData(params)
+		if perr != nil && !retryable(perr) {
+			s.log.Errorf("dropping %d datapoints rejected by cloudwatch: %s", n, perr)
+			s.queue.addDropped(n)
+			err = perr
+		} else if perr != nil {
+			s.log.Errorf("error pushing metrics: %s", perr)
+			for _, datum := range data[:n] {
+				s.queue.push(s.namespace, datum)
+			}
+			err = perr
+		}
+		data = data[n:]
+	}
+	return err
+}
+
+// runRetries pushes again the queued datapoints, oldest first. while
+// CloudWatch keeps failing the retries are spaced by the backoff
+func (s *apiSink) runRetries() {
+	defer close(s.done)
+	attempt := 0
+	for {
+		delay := s.backoff.Initial
+		if attempt > 0 {
+			delay = s.backoff.Delay(attempt)
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(delay):
+		}
+		n, err := s.pushQueued(context.Background())
+		if err != nil {
+			attempt += 1
+			s.log.Warnf("error pushing %d queued datapoints (%d waiting), retrying in %s: %s", n, s.queue.Len(), s.backoff.Delay(attempt), err)
+			continue
+		}
+		attempt = 0
+	}
+}
+
+// pushQueued pushes the queued datapoints until the queue is empty, the
+// context is done or a push fails, in which case the size of the failed
+// batch is returned with the error. a batch CloudWatch rejects for good is
+// dropped so that it does not hold back the ones behind it
+func (s *apiSink) pushQueued(ctx context.Context) (n int, err error) {
+	for ctx.Err() == nil {
+		batch := s.queue.peek(putBatchSize, time.Now())
+		if len(batch) == 0 {
+			return 0, nil
+		}
+		params := &cloudwatch.PutMetricDataInput{
+			MetricData: make([]*cloudwatch.MetricDatum, 0, len(batch)),
+			Namespace:  aws.String(batch[0].Namespace),
+		}
+		for _, e := range batch {
+			params.MetricData = append(params.MetricData, e.Datum)
+		}
+		_, err := s.client.PutMetricData(params)
+		if err != nil && !retryable(err) {
+			s.log.Errorf("dropping %d queued datapoints rejected by cloudwatch: %s", len(batch), err)
+			s.queue.drop(batch)
+			continue
+		}
+		if err != nil {
+			return len(batch), err
+		}
+		s.queue.remove(batch)
+	}
+	return 0, ctx.Err()
+}
+
+// close stops the retries and makes a last attempt at pushing the queued
+// datapoints. the ones still queued afterwards are kept on disk when the
+// queue has a file, otherwise they are lost and an error is returned
+func (s *apiSink) close(ctx context.Context) error {
+	close(s.quit)
+	<-s.done
+	_, err := s.pushQueued(ctx)
+	left := s.queue.Len()
+	if left == 0 {
+		return nil
+	}
+	if s.queue.path != "" {
+		s.log.Errorf("%d queued datapoints left in %s: %s", left, s.queue.path, err)
+		return nil
+	}
+	return fmt.Errorf("%d queued datapoints lost: %s", left, err)
+}
+
+func (s *apiSink) checkClient() (err error) {
+	params := &cloudwatch.ListMetricsInput{}
+	_, err = s.client.ListMetrics(params)
+	return err
+}
+
+// retryable tells whether a failed push may succeed later: throttling,
+// server and network errors are temporary while a request CloudWatch
+// rejects as invalid is going to be rejected again
+func retryable(err error) bool {
+	rerr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return true
+	}
+	status := rerr.StatusCode()
+	if status < 400 || status >= 500 || status == 429 {
+		return true
+	}
+	switch rerr.Code() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded", "RequestTimeout", "RequestTimeoutException":
+		return true
+	}
+	return false
+}
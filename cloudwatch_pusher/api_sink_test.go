@@ -0,0 +1,235 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"golang.org/x/net/context"
+)
+
+// fakeCloudWatch stands in for CloudWatch, failing every push with fail
+// when set and recording the datapoints pushed otherwise
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	sync.Mutex
+	fail   func(data []*cloudwatch.MetricDatum) error
+	pushed []string
+}
+
+func (f *fakeCloudWatch) PutMetricData(in *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.fail != nil {
+		err := f.fail(in.MetricData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, datum := range in.MetricData {
+		f.pushed = append(f.pushed, aws.StringValue(datum.MetricName))
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func (f *fakeCloudWatch) ListMetrics(in *cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+	return &cloudwatch.ListMetricsOutput{}, nil
+}
+
+func (f *fakeCloudWatch) setFail(fail func(data []*cloudwatch.MetricDatum) error) {
+	f.Lock()
+	f.fail = fail
+	f.Unlock()
+}
+
+func (f *fakeCloudWatch) pushedNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.pushed...)
+}
+
+func newTestAPISink(t *testing.T, client *fakeCloudWatch, path string, size int) *apiSink {
+	opts := DefaultOptions
+	opts.NameSpace = "ns"
+	opts.RetryQueuePath = path
+	opts.RetryQueueSize = size
+	// the retries are run by hand
+	opts.RetryBackoff.Initial = time.Hour
+	s, err := newAPISink(client, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func data(from, to int) []*cloudwatch.MetricDatum {
+	data := make([]*cloudwatch.MetricDatum, 0, to-from)
+	for i := from; i < to; i++ {
+		data = append(data, newDatum(i))
+	}
+	return data
+}
+
+func checkPushed(t *testing.T, client *fakeCloudWatch, from, to int) {
+	got := client.pushedNames()
+	if len(got) != to-from {
+		t.Fatalf("expected %d pushed datapoints, got %d: %v", to-from, len(got), got)
+	}
+	for i, name := range got {
+		if name != fmt.Sprintf("metric-%d", from+i) {
+			t.Fatalf("expected metric-%d pushed at %d, got %s", from+i, i, name)
+		}
+	}
+}
+
+func TestAPISinkRetriesFailedPushes(t *testing.T) {
+	client := &fakeCloudWatch{}
+	s := newTestAPISink(t, client, "", 0)
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return fmt.Errorf("connection refused")
+	})
+	err := s.push(nil, nil, data(0, 30))
+	if err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	if s.queue.Len() != 30 {
+		t.Fatalf("expected 30 queued datapoints, got %d", s.queue.Len())
+	}
+	n, err := s.pushQueued(context.Background())
+	if err == nil || n != putBatchSize {
+		t.Fatalf("expected a batch of %d to fail, got %d: %v", putBatchSize, n, err)
+	}
+
+	client.setFail(nil)
+	_, err = s.pushQueued(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPushed(t, client, 0, 30)
+	if s.queue.Len() != 0 {
+		t.Fatalf("expected an empty queue, got %d", s.queue.Len())
+	}
+	err = s.close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPISinkDropsRejectedBatches(t *testing.T) {
+	client := &fakeCloudWatch{}
+	s := newTestAPISink(t, client, "", 0)
+	defer s.close(context.Background())
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return fmt.Errorf("connection refused")
+	})
+	s.push(nil, nil, data(0, 40))
+	// the first batch turns out to be invalid, it must not hold back the
+	// following one
+	client.setFail(func(data []*cloudwatch.MetricDatum) error {
+		if aws.StringValue(data[0].MetricName) == "metric-0" {
+			return awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "invalid datapoint", nil), 400, "request")
+		}
+		return nil
+	})
+	_, err := s.pushQueued(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPushed(t, client, putBatchSize, 40)
+	if s.queue.Dropped() != putBatchSize {
+		t.Fatalf("expected %d dropped datapoints, got %d", putBatchSize, s.queue.Dropped())
+	}
+}
+
+func TestAPISinkRetriesThrottling(t *testing.T) {
+	client := &fakeCloudWatch{}
+	s := newTestAPISink(t, client, "", 0)
+	defer s.close(context.Background())
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), 400, "request")
+	})
+	s.push(nil, nil, data(0, 5))
+	if s.queue.Len() != 5 || s.queue.Dropped() != 0 {
+		t.Fatalf("expected throttled datapoints to be queued, %d queued %d dropped", s.queue.Len(), s.queue.Dropped())
+	}
+}
+
+func TestAPISinkFullQueue(t *testing.T) {
+	client := &fakeCloudWatch{}
+	s := newTestAPISink(t, client, "", 25)
+	defer s.close(context.Background())
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return fmt.Errorf("connection refused")
+	})
+	s.push(nil, nil, data(0, 40))
+	if s.queue.Len() != 25 || s.queue.Dropped() != 15 {
+		t.Fatalf("expected 25 queued and 15 dropped datapoints, got %d and %d", s.queue.Len(), s.queue.Dropped())
+	}
+	client.setFail(nil)
+	s.pushQueued(context.Background())
+	checkPushed(t, client, 15, 40)
+}
+
+func TestAPISinkTrimDuringPush(t *testing.T) {
+	client := &fakeCloudWatch{}
+	s := newTestAPISink(t, client, "", 30)
+	defer s.close(context.Background())
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return fmt.Errorf("connection refused")
+	})
+	s.push(nil, nil, data(0, 30))
+	// new datapoints fail and fill the queue while the oldest batch is
+	// being pushed again
+	client.setFail(func(data []*cloudwatch.MetricDatum) error {
+		if aws.StringValue(data[0].MetricName) == "metric-0" {
+			go s.queue.push("ns", newDatum(30))
+			for s.queue.Len() == 30 && s.queue.Dropped() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return nil
+	})
+	_, err := s.pushQueued(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// metric-0 was pushed even though it was dropped meanwhile, every other
+	// datapoint is pushed exactly once
+	checkPushed(t, client, 0, 31)
+}
+
+func TestAPISinkReloadsQueue(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	client := &fakeCloudWatch{}
+	client.setFail(func([]*cloudwatch.MetricDatum) error {
+		return fmt.Errorf("connection refused")
+	})
+	s := newTestAPISink(t, client, path, 0)
+	s.push(nil, nil, data(0, 10))
+	err := s.close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.setFail(nil)
+	s = newTestAPISink(t, client, path, 0)
+	if s.queue.Len() != 10 {
+		t.Fatalf("expected 10 datapoints reloaded, got %d", s.queue.Len())
+	}
+	err = s.close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPushed(t, client, 0, 10)
+	s = newTestAPISink(t, client, path, 0)
+	defer s.close(context.Background())
+	if s.queue.Len() != 0 {
+		t.Fatalf("expected the pushed datapoints to be gone, %d left", s.queue.Len())
+	}
+}
@@ -0,0 +1,113 @@
+package cloudwatch_pusher
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+const (
+	// maxDistinctValues is the maximum number of distinct values CloudWatch
+	// accepts in a single datapoint
+	maxDistinctValues = 150
+)
+
+// datapoints collects the datapoints of a collection round before they are
+// handed to the sinks. they all share the round timestamp, the start of the
+// round, and the group dimension
+type datapoints struct {
+	group          string
+	timestamp      time.Time
+	highResolution bool
+	data           []*cloudwatch.MetricDatum
+}
+
+func (c *CloudWatchPusher) newDatapoints(r *u.Round) *datapoints {
+	return &datapoints{
+		group:          c.AutoscalingGroupName,
+		timestamp:      r.Start,
+		highResolution: c.HighResolution,
+	}
+}
+
+func (d *datapoints) dimensions(extraDimensions ...*cloudwatch.Dimension) []*cloudwatch.Dimension {
+	dimensions := []*cloudwatch.Dimension{
+		{
+			Name:  aws.String("AutoscalingGroupName"),
+			Value: aws.String(d.group),
+		},
+	}
+	return append(dimensions, extraDimensions...)
+}
+
+func (d *datapoints) newDatum(metricName, unit string, extraDimensions ...*cloudwatch.Dimension) *cloudwatch.MetricDatum {
+	datum := &cloudwatch.MetricDatum{
+		MetricName: aws.String(metricName),
+		Dimensions: d.dimensions(extraDimensions...),
+		Timestamp:  aws.Time(d.timestamp),
+		Unit:       aws.String(unit),
+	}
+	if d.highResolution {
+		datum.StorageResolution = aws.Int64(1)
+	}
+	d.data = append(d.data, datum)
+	return datum
+}
+
+// add adds a single value
+func (d *datapoints) add(metricName, unit string, value float64, extraDimensions ...*cloudwatch.Dimension) {
+	d.newDatum(metricName, unit, extraDimensions...).Value = aws.Float64(value)
+}
+
+// addGlobal adds a single value that is not about the group, without the
+// group dimension
+func (d *datapoints) addGlobal(metricName, unit string, value float64, dimensions ...*cloudwatch.Dimension) {
+	datum := d.newDatum(metricName, unit)
+	datum.Dimensions = dimensions
+	datum.Value = aws.Float64(value)
+}
+
+// addStatisticSet adds a set of values as a single statistic set, so that
+// CloudWatch can compute their average, minimum and maximum
+func (d *datapoints) addStatisticSet(metricName, unit string, values []float64, extraDimensions ...*cloudwatch.Dimension) {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	d.newDatum(metricName, unit, extraDimensions...).StatisticValues = &cloudwatch.StatisticSet{
+		SampleCount: aws.Float64(float64(len(values))),
+		Sum:         aws.Float64(sum),
+		Minimum:     aws.Float64(statistic(values, STATISTIC_MIN)),
+		Maximum:     aws.Float64(statistic(values, STATISTIC_MAX)),
+	}
+}
+
+// addValues adds a set of values as arrays of distinct values and the number
+// of times each was seen, split in as many datapoints as needed to stay
+// within the CloudWatch limit of distinct values per datapoint
+func (d *datapoints) addValues(metricName, unit string, values []float64, extraDimensions ...*cloudwatch.Dimension) {
+	counts := make(map[float64]float64)
+	for _, v := range values {
+		counts[v] += 1.0
+	}
+	distinct := make([]float64, 0, len(counts))
+	for v := range counts {
+		distinct = append(distinct, v)
+	}
+	sort.Float64s(distinct)
+	for len(distinct) > 0 {
+		n := len(distinct)
+		if n > maxDistinctValues {
+			n = maxDistinctValues
+		}
+		datum := d.newDatum(metricName, unit, extraDimensions...)
+		for _, v := range distinct[:n] {
+			datum.Values = append(datum.Values, aws.Float64(v))
+			datum.Counts = append(datum.Counts, aws.Float64(counts[v]))
+		}
+		distinct = distinct[n:]
+	}
+}
@@ -0,0 +1,204 @@
+package cloudwatch_pusher
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
+)
+
+// emfSink writes the datapoints as CloudWatch Embedded Metric Format
+// documents, one json document per line, to be shipped to CloudWatch Logs
+// which extracts the metrics from them. no CloudWatch API call is made
+type emfSink struct {
+	w              io.Writer
+	file           *os.File
+	namespace      string
+	group          string
+	highResolution bool
+	log            *logging.Logger
+}
+
+type emfMetric struct {
+	Name              string `json:"Name"`
+	Unit              string `json:"Unit,omitempty"`
+	StorageResolution int    `json:"StorageResolution,omitempty"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfDocument is a single EMF document: the metadata telling CloudWatch
+// which of the fields are metrics, the dimensions and the metric values as
+// top level fields, and any other property
+type emfDocument struct {
+	metadata emfMetadata
+	fields   map[string]interface{}
+}
+
+// newEMFSink creates a sink writing to the given file, or to the standard
+// output when path is empty or "-"
+func newEMFSink(path string, opts Options) (s *emfSink, err error) {
+	s = &emfSink{
+		w:              os.Stdout,
+		namespace:      opts.NameSpace,
+		group:          opts.AutoscalingGroupName,
+		highResolution: opts.HighResolution,
+		log:            logger.With("group", opts.AutoscalingGroupName),
+	}
+	if path != "" && path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+		if err != nil {
+			s.log.Errorf("error opening emf output %s: %s", path, err)
+			return nil, err
+		}
+		s.w = f
+		s.file = f
+	}
+	return s, nil
+}
+
+// close flushes the output file to disk and closes it
+func (s *emfSink) close(ctx context.Context) error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *emfSink) name() string {
+	return "emf"
+}
+
+func (s *emfSink) newDocument(timestamp time.Time, dimensions []*cloudwatch.Dimension) *emfDocument {
+	names := make([]string, 0, len(dimensions))
+	doc := &emfDocument{
+		fields: make(map[string]interface{}),
+	}
+	for _, d := range dimensions {
+		names = append(names, aws.StringValue(d.Name))
+		doc.fields[aws.StringValue(d.Name)] = aws.StringValue(d.Value)
+	}
+	doc.metadata = emfMetadata{
+		Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{
+			{
+				Namespace:  s.namespace,
+				Dimensions: [][]string{names},
+			},
+		},
+	}
+	return doc
+}
+
+func (s *emfSink) addMetric(doc *emfDocument, name, unit string, value float64) {
+	metric := emfMetric{
+		Name: name,
+		Unit: unit,
+	}
+	if s.highResolution {
+		metric.StorageResolution = 1
+	}
+	doc.metadata.CloudWatchMetrics[0].Metrics = append(doc.metadata.CloudWatchMetrics[0].Metrics, metric)
+	doc.fields[name] = value
+}
+
+func (doc *emfDocument) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(doc.fields)+1)
+	for k, v := range doc.fields {
+		fields[k] = v
+	}
+	fields["_aws"] = doc.metadata
+	return json.Marshal(fields)
+}
+
+// dimensionsKey identifies a set of dimensions, datapoints sharing it are
+// written in the same document
+func dimensionsKey(dimensions []*cloudwatch.Dimension) string {
+	parts := make([]string, 0, len(dimensions))
+	for _, d := range dimensions {
+		parts = append(parts, aws.StringValue(d.Name)+"="+aws.StringValue(d.Value))
+	}
+	return strings.Join(parts, ",")
+}
+
+// push writes a document for every set of dimensions of the group
+// datapoints and one for every host, carrying its metrics with an additional
+// "host" dimension and the full uwsgi stats of its last poll as properties.
+// statistic sets and value arrays are left out since the host documents
+// already hold every single host value
+func (s *emfSink) push(r *u.Round, snap *snapshot, data []*cloudwatch.MetricDatum) (err error) {
+	docs := make(map[string]*emfDocument)
+	keys := make([]string, 0)
+	for _, datum := range data {
+		if datum.Value == nil {
+			continue
+		}
+		key := dimensionsKey(datum.Dimensions)
+		doc, ok := docs[key]
+		if !ok {
+			doc = s.newDocument(aws.TimeValue(datum.Timestamp), datum.Dimensions)
+			docs[key] = doc
+			keys = append(keys, key)
+		}
+		s.addMetric(doc, aws.StringValue(datum.MetricName), aws.StringValue(datum.Unit), aws.Float64Value(datum.Value))
+	}
+	sort.Strings(keys)
+	encoder := json.NewEncoder(s.w)
+	for _, key := range keys {
+		werr := encoder.Encode(docs[key])
+		if werr != nil {
+			err = werr
+		}
+	}
+	for id, h := range snap.hosts {
+		doc := s.newDocument(r.Start, []*cloudwatch.Dimension{
+			{
+				Name:  aws.String("AutoscalingGroupName"),
+				Value: aws.String(s.group),
+			},
+			{
+				Name:  aws.String("host"),
+				Value: aws.String(id),
+			},
+		})
+		for _, m := range hostMetrics {
+			s.addMetric(doc, m.name, m.unit, m.value(h))
+		}
+		doc.fields["round"] = r.ID
+		doc.fields["labels"] = h.labels
+		doc.fields["stale"] = h.stale
+		if h.stats != nil {
+			doc.fields["stats"] = h.stats
+		}
+		werr := encoder.Encode(doc)
+		if werr != nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		s.log.Errorf("error writing emf documents: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+// what to do with a round whose coverage is below MinCoverage
+const (
+	INCOMPLETE_ROUND_FLAG = iota
+	INCOMPLETE_ROUND_SKIP
+)
+
+// what to do with a host that did not report in a round but is still within
+// its StaleGrace
+const (
+	STALE_EXCLUDE = iota
+	STALE_ZERO
+	STALE_CARRY_FORWARD
+)
+
+// how the single host values of every metric are pushed along with the group
+// value
+const (
+	HOST_VALUES_NONE = iota
+	HOST_VALUES_STATISTIC_SET
+	HOST_VALUES_ARRAY
+)
+
+// where the metrics are published
+const (
+	SINK_API = iota
+	SINK_EMF
+)
+
+var (
+	incompleteRoundPolicies = map[string]int{
+		"flag": INCOMPLETE_ROUND_FLAG,
+		"skip": INCOMPLETE_ROUND_SKIP,
+	}
+	stalePolicies = map[string]int{
+		"exclude": STALE_EXCLUDE,
+		"zero":    STALE_ZERO,
+		"carry":   STALE_CARRY_FORWARD,
+	}
+	hostValuesModes = map[string]int{
+		"none":          HOST_VALUES_NONE,
+		"statistic-set": HOST_VALUES_STATISTIC_SET,
+		"values":        HOST_VALUES_ARRAY,
+	}
+	sinks = map[string]int{
+		"api": SINK_API,
+		"emf": SINK_EMF,
+	}
+
+	// IncompleteRoundPolicyNames lists the accepted names of the incomplete
+	// round policies
+	IncompleteRoundPolicyNames = []string{"flag", "skip"}
+	// StalePolicyNames lists the accepted names of the stale host policies
+	StalePolicyNames = []string{"exclude", "zero", "carry"}
+	// HostValuesModeNames lists the accepted names of the host values modes
+	HostValuesModeNames = []string{"none", "statistic-set", "values"}
+	// SinkNames lists the accepted names of the sinks
+	SinkNames = []string{"api", "emf"}
+)
+
+func IncompleteRoundPolicyFromString(name string) (int, error) {
+	policy, ok := incompleteRoundPolicies[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown incomplete round policy %s, must be one of %s", name, strings.Join(IncompleteRoundPolicyNames, ","))
+	}
+	return policy, nil
+}
+
+func StalePolicyFromString(name string) (int, error) {
+	policy, ok := stalePolicies[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown stale policy %s, must be one of %s", name, strings.Join(StalePolicyNames, ","))
+	}
+	return policy, nil
+}
+
+func HostValuesModeFromString(name string) (int, error) {
+	mode, ok := hostValuesModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown host values mode %s, must be one of %s", name, strings.Join(HostValuesModeNames, ","))
+	}
+	return mode, nil
+}
+
+func SinkFromString(name string) (int, error) {
+	sink, ok := sinks[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown sink %s, must be one of %s", name, strings.Join(SinkNames, ","))
+	}
+	return sink, nil
+}
+
+// Options configure what the pusher publishes and how it treats incomplete
+// rounds and hosts that stopped reporting
+type Options struct {
+	// Sinks are where the metrics are published: the CloudWatch API and/or
+	// EMF documents written to EMFOutput, a file or "-" for the standard
+	// output
+	Sinks                []int
+	EMFOutput            string
+	NameSpace            string
+	AutoscalingGroupName string
+	PerHostMetrics       bool
+	// MinCoverage is the fraction of the expected hosts that must have
+	// reported in a round for it to be pushed normally
+	MinCoverage           float64
+	IncompleteRoundPolicy int
+	// StaleGrace is how long a host that stopped reporting is still taken
+	// into account according to StalePolicy, after that it is forgotten
+	StaleGrace  time.Duration
+	StalePolicy int
+	// HostStatistics are the statistics of the single host values pushed
+	// along with the group value of every host metric, HostValues is how the
+	// host values themselves are pushed
+	HostStatistics []int
+	HostValues     int
+	// HighResolution pushes every metric with a one second storage
+	// resolution, needed to make use of rounds shorter than a minute
+	HighResolution bool
+	// SelfMetrics pushes the metrics about the poller itself, given with
+	// SetSelfMetrics, along with every round
+	SelfMetrics bool
+	// RetryQueuePath is the file where the datapoints that failed to be
+	// pushed are kept until they are pushed again, when empty they are only
+	// kept in memory. at most RetryQueueSize datapoints are kept, none older
+	// than RetryMaxAge
+	RetryQueuePath string
+	RetryQueueSize int
+	RetryMaxAge    time.Duration
+	RetryBackoff   u.Backoff
+}
+
+var DefaultOptions = Options{
+	Sinks:                 []int{SINK_API},
+	EMFOutput:             "-",
+	IncompleteRoundPolicy: INCOMPLETE_ROUND_FLAG,
+	StaleGrace:            time.Minute,
+	StalePolicy:           STALE_EXCLUDE,
+	HostValues:            HOST_VALUES_NONE,
+	RetryQueueSize:        10000,
+	RetryMaxAge:           cloudWatchMaxAge,
+	RetryBackoff: u.Backoff{
+		Initial:    10 * time.Second,
+		Max:        5 * time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	},
+}
+
+// HasSink tells whether the given sink is configured
+func (o Options) HasSink(sink int) bool {
+	for _, s := range o.Sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
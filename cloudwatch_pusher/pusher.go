@@ -1,7 +1,7 @@
 package cloudwatch_pusher
 
 import (
-	"log"
+	"fmt"
 	"sync"
 	"time"
 
@@ -9,134 +9,527 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
 	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
 )
 
-const (
-	hostLatenessTimeoutMinutes = 3
-)
+var logger = logging.New("cloudwatch")
+
+// sink publishes the datapoints of a collection round. the snapshot of the
+// round is handed over as well for the sinks publishing per host data
+type sink interface {
+	name() string
+	push(r *u.Round, snap *snapshot, data []*cloudwatch.MetricDatum) error
+	// close flushes what the sink still holds, within the context deadline
+	close(ctx context.Context) error
+}
 
 type CloudWatchPusher struct {
-	client *cloudwatch.CloudWatch
-	sync.Mutex
-	NameSpace             string
-	AutoscalingGroupName  string
-	hostLastSeen          map[string]time.Time
-	totalWorkers          map[string]float64
-	idleWorkers           map[string]float64
-	busyWorkers           map[string]float64
-	exceptionsCount       map[string]float64
-	busyWorkersPercentage map[string]float64
-	idleWorkersPercentage map[string]float64
-}
-
-func (c *CloudWatchPusher) newDatapoint(metricName, namespace, autoscalingGroupName, unit string, value float64) (err error) {
-	params := &cloudwatch.PutMetricDataInput{
-		MetricData: []*cloudwatch.MetricDatum{
-			{
-				MetricName: aws.String(metricName),
-				Dimensions: []*cloudwatch.Dimension{
-					{
-						Name:  aws.String("AutoscalingGroupName"),
-						Value: aws.String(autoscalingGroupName),
-					},
-				},
-				Value: aws.Float64(value),
-				Unit:  aws.String(unit),
-			},
-		},
-		Namespace: aws.String(namespace),
-	}
-	_, err = c.client.PutMetricData(params)
-	if err != nil {
-		log.Printf("error pushing metrics: %s", err)
-		return err
+	Options
+	log    *logging.Logger
+	store  *store
+	sinks  []sink
+	rounds chan *u.Round
+	quit   chan int
+	done   chan int
+
+	// lastPush is the time of the last successful push of every sink,
+	// starting from the creation of the pusher
+	pushLock      sync.Mutex
+	lastPush      map[string]time.Time
+	pushLatency   map[string]*u.Histogram
+	pushes        map[string]int64
+	pushFailures  map[string]int64
+	droppedRounds int64
+	selfMetrics   func(c *CloudWatchPusher) []SelfMetric
+}
+
+// SelfMetric is a metric about the poller itself, pushed along with the
+// metrics of every round. a Global metric is about the whole process rather
+// than the group and is pushed without the group dimension
+type SelfMetric struct {
+	Name       string
+	Unit       string
+	Value      float64
+	Dimensions map[string]string
+	Global     bool
+}
+
+// SinkStats are the totals of the pushes to a sink since the pusher started
+type SinkStats struct {
+	Pushes   int64               `json:"pushes"`
+	Failures int64               `json:"failures"`
+	Latency  u.HistogramSnapshot `json:"latency_ms"`
+	LastPush time.Time           `json:"last_push"`
+}
+
+// addHostMetric adds the group value of a metric along with the configured
+// statistics of the single host values and, depending on HostValues, the
+// host values themselves as a "-per-host" metric
+func (c *CloudWatchPusher) addHostMetric(d *datapoints, m *metric, snap *snapshot) {
+	d.add(m.name, m.unit, m.aggregate(snap))
+	values := m.values(snap)
+	if len(values) == 0 {
+		return
+	}
+	for _, s := range c.HostStatistics {
+		d.add(fmt.Sprintf("%s-%s", m.name, statisticName(s)), m.unit, statistic(values, s))
+	}
+	name := fmt.Sprintf("%s-per-host", m.name)
+	switch c.HostValues {
+	case HOST_VALUES_STATISTIC_SET:
+		d.addStatisticSet(name, m.unit, values)
+	case HOST_VALUES_ARRAY:
+		d.addValues(name, m.unit, values)
 	}
-	return nil
 }
 
-func (c *CloudWatchPusher) pushAggregateMetric(name string, data map[string]float64) {
-	total := float64(0.0)
-	for _, datapoint := range data {
-		total += datapoint
+func percentage(part, total float64) float64 {
+	if total == 0 {
+		return 0.0
 	}
-	err := c.newDatapoint(name, c.NameSpace, c.AutoscalingGroupName, "Count", total)
-	if err != nil {
-		log.Printf("error pushing %s metric: %s", name, err)
+	return (part * 100.0) / total
+}
+
+// addCoreMetrics adds the core level utilisation of the group and, when
+// PerHostMetrics is set, of every single host with an additional "host"
+// dimension. percentages are computed on the group totals
+func (c *CloudWatchPusher) addCoreMetrics(d *datapoints, snap *snapshot) {
+	var totalCores, busyCores, saturationBusy, saturationCapacity float64
+	for _, h := range snap.hosts {
+		totalCores += h.totalCores
+		busyCores += h.busyCores
+		saturationBusy += h.saturationBusy
+		saturationCapacity += h.saturationCapacity
+	}
+	addCoreDatapoints(d, totalCores, busyCores, saturationBusy, saturationCapacity)
+	if !c.PerHostMetrics {
+		return
+	}
+	for host, h := range snap.hosts {
+		dimension := &cloudwatch.Dimension{
+			Name:  aws.String("host"),
+			Value: aws.String(host),
+		}
+		addCoreDatapoints(d, h.totalCores, h.busyCores, h.saturationBusy, h.saturationCapacity, dimension)
+	}
+}
+
+func addCoreDatapoints(d *datapoints, totalCores, busyCores, saturationBusy, saturationCapacity float64, dimensions ...*cloudwatch.Dimension) {
+	d.add("total-cores", "Count", totalCores, dimensions...)
+	d.add("busy-cores", "Count", busyCores, dimensions...)
+	d.add("idle-cores", "Count", totalCores-busyCores, dimensions...)
+	d.add("busy-cores-percentage", "Percent", percentage(busyCores, totalCores), dimensions...)
+	d.add("idle-cores-percentage", "Percent", percentage(totalCores-busyCores, totalCores), dimensions...)
+	d.add("saturation-percentage", "Percent", percentage(saturationBusy, saturationCapacity), dimensions...)
+}
+
+// addHealthMetrics adds the number of hosts in each health state
+func addHealthMetrics(d *datapoints, snap *snapshot) {
+	for _, health := range []int{u.HEALTH_UP, u.HEALTH_DEGRADED, u.HEALTH_DOWN} {
+		d.add(fmt.Sprintf("hosts-%s", u.HealthName(health)), "Count", snap.countHealth(health))
 	}
 }
 
+// addEventMetrics adds the number of poller events received since the last
+// push with an additional "reason" dimension
+func addEventMetrics(d *datapoints, snap *snapshot) {
+	for reason, count := range snap.events {
+		dimension := &cloudwatch.Dimension{
+			Name:  aws.String("reason"),
+			Value: aws.String(reason),
+		}
+		d.add("poller-events", "Count", count, dimension)
+	}
+}
+
+// addStatusMetrics adds the number of workers in each uwsgi status with an
+// additional "status" dimension
+func addStatusMetrics(d *datapoints, snap *snapshot) {
+	totals := make(map[string]float64)
+	for _, h := range snap.hosts {
+		for status, count := range h.statusCounts {
+			totals[status] += count
+		}
+	}
+	for status, total := range totals {
+		dimension := &cloudwatch.Dimension{
+			Name:  aws.String("status"),
+			Value: aws.String(status),
+		}
+		d.add("workers-by-status", "Count", total, dimension)
+	}
+}
+
+// addAppMetrics adds the per application metrics with an additional "app"
+// dimension. rates are summed across hosts, the startup time is the slowest
+// seen on any host
+func addAppMetrics(d *datapoints, snap *snapshot) {
+	requestsRate := make(map[string]float64)
+	exceptionsRate := make(map[string]float64)
+	startupTime := make(map[string]float64)
+	for _, h := range snap.hosts {
+		for name, app := range h.apps {
+			if app.rated {
+				requestsRate[name] += app.requestsRate
+				exceptionsRate[name] += app.exceptionsRate
+			}
+			if app.startupTime > startupTime[name] {
+				startupTime[name] = app.startupTime
+			}
+		}
+	}
+	for name := range startupTime {
+		dimension := &cloudwatch.Dimension{
+			Name:  aws.String("app"),
+			Value: aws.String(name),
+		}
+		if rate, ok := requestsRate[name]; ok {
+			d.add("app-requests-rate", "Count/Second", rate, dimension)
+		}
+		if rate, ok := exceptionsRate[name]; ok {
+			d.add("app-exceptions-rate", "Count/Second", rate, dimension)
+		}
+		d.add("app-startup-time", "Seconds", startupTime[name], dimension)
+	}
+}
+
+// CloseRound queues a closed collection round to be pushed. it never blocks
+// the caller, a round that cannot be queued is dropped
+func (c *CloudWatchPusher) CloseRound(r *u.Round) {
+	select {
+	case c.rounds <- r:
+	default:
+		c.log.Warnf("pusher is falling behind, dropping %s", r)
+		c.pushLock.Lock()
+		c.droppedRounds += 1
+		c.pushLock.Unlock()
+	}
+}
+
+// Run pushes the metrics of every closed round. each push works on a
+// snapshot of the hosts that reported in the round, so that it sees a
+// consistent view and never mixes fresh samples with old ones
 func (c *CloudWatchPusher) Run() {
-	ticker := time.NewTicker(time.Duration(1) * time.Minute)
+	defer close(c.done)
 	for {
 		select {
-		case <-ticker.C:
-			c.pushAggregateMetric("total-workers", c.totalWorkers)
-			c.pushAggregateMetric("idle-workers", c.idleWorkers)
-			c.pushAggregateMetric("busy-workers", c.busyWorkers)
-			c.pushAggregateMetric("exceptions-count", c.exceptionsCount)
-			c.pushAggregateMetric("busy-workers-percentage", c.busyWorkersPercentage)
-			c.pushAggregateMetric("idle-workers-percentage", c.idleWorkersPercentage)
+		case <-c.quit:
+			// push what was closed before stopping
+			for {
+				select {
+				case r := <-c.rounds:
+					c.pushRound(r)
+				default:
+					return
+				}
+			}
+		case r := <-c.rounds:
+			c.pushRound(r)
 		}
 	}
 }
 
-func (c *CloudWatchPusher) expireOldHosts() {
+// Stop pushes the rounds already closed, then flushes and closes the sinks.
+// an error is returned when this cannot be done before the context is done
+// or when a sink fails to flush
+func (c *CloudWatchPusher) Stop(ctx context.Context) error {
+	close(c.quit)
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return fmt.Errorf("rounds left unpushed: %s", ctx.Err())
+	}
+	return c.closeSinks(ctx)
+}
+
+func (c *CloudWatchPusher) closeSinks(ctx context.Context) (err error) {
+	for _, s := range c.sinks {
+		serr := s.close(ctx)
+		if serr != nil {
+			c.log.Errorf("error closing the %s sink: %s", s.name(), serr)
+			err = fmt.Errorf("%s sink: %s", s.name(), serr)
+		}
+	}
+	return err
+}
+
+// TakeOver makes the pusher continue from the state of the hosts of another
+// one, e.g. the one it replaces after a configuration change, so that no
+// sample or baseline is lost. the rounds closed after the old pusher was
+// stopped are pushed by the new one. it must be called before Run
+func (c *CloudWatchPusher) TakeOver(old *CloudWatchPusher) {
+	c.store = old.store
 	for {
-		now := time.Now().Add(-hostLatenessTimeoutMinutes * time.Minute)
-		for host, lastSeen := range c.hostLastSeen {
-			if lastSeen.Before(now) {
-				log.Printf("removing host with id %s since it has been missing for %d minutes", host, hostLatenessTimeoutMinutes)
-				delete(c.totalWorkers, host)
-				delete(c.busyWorkers, host)
-				delete(c.idleWorkers, host)
-				delete(c.busyWorkersPercentage, host)
-				delete(c.idleWorkersPercentage, host)
-				delete(c.exceptionsCount, host)
-				delete(c.hostLastSeen, host)
-			}
+		select {
+		case r := <-old.rounds:
+			c.CloseRound(r)
+		default:
+			return
 		}
-		time.Sleep(time.Duration(30) * time.Second)
 	}
 }
 
+// pushRound pushes the metrics of a round to every sink along with its
+// coverage, the fraction of the expected hosts that reported in it, and the
+// number of stale hosts. a round whose coverage is below MinCoverage is
+// either skipped or flagged as incomplete. of a skipped round only the
+// coverage is pushed, the counters since the previous push are left in
+// place for the next round that is published
+func (c *CloudWatchPusher) pushRound(r *u.Round) {
+	now := time.Now()
+	staleDeadline := now.Add(-c.StaleGrace)
+	snap := c.store.snapshot(now, r.ID, staleDeadline, c.StalePolicy, false)
+	c.logExpired(snap.expired)
+	if coverage := c.coverage(r, snap); coverage < c.MinCoverage && c.IncompleteRoundPolicy == INCOMPLETE_ROUND_SKIP {
+		c.log.Warnf("%s has coverage %.2f below %.2f, skipping its push", r, coverage, c.MinCoverage)
+		// the counters of the skipped round go to the next push
+		c.store.restore(snap)
+		d := c.newDatapoints(r)
+		d.add("round-coverage", "Percent", coverage*100.0)
+		c.push(r, &snapshot{round: r.ID}, d)
+		return
+	}
+	d, coverage := c.build(r, snap)
+	c.addSelfMetrics(d)
+	if coverage < c.MinCoverage {
+		c.log.Warnf("%s has coverage %.2f below %.2f", r, coverage, c.MinCoverage)
+	}
+	c.push(r, snap, d)
+}
+
+func (c *CloudWatchPusher) logExpired(hosts []string) {
+	for _, host := range hosts {
+		c.log.Infof("removing host %s since it has been missing for more than %s", host, c.StaleGrace)
+	}
+}
+
+// coverage returns the fraction of the hosts expected in a round that
+// reported in it
+func (c *CloudWatchPusher) coverage(r *u.Round, snap *snapshot) float64 {
+	if r.Expected == 0 {
+		return 1.0
+	}
+	coverage := float64(snap.reported) / float64(r.Expected)
+	if coverage > 1.0 {
+		coverage = 1.0
+	}
+	return coverage
+}
+
+// Preview returns the datapoints that would be pushed for a round if it
+// were closed now, without affecting the next push
+func (c *CloudWatchPusher) Preview(r *u.Round) []*cloudwatch.MetricDatum {
+	now := time.Now()
+	snap := c.store.snapshot(now, r.ID, now.Add(-c.StaleGrace), c.StalePolicy, true)
+	d, _ := c.build(r, snap)
+	return d.data
+}
+
+// build computes the datapoints of a round out of its snapshot, along with
+// the round coverage
+func (c *CloudWatchPusher) build(r *u.Round, snap *snapshot) (*datapoints, float64) {
+	d := c.newDatapoints(r)
+	d.add("stale-hosts", "Count", float64(snap.stale))
+	coverage := c.coverage(r, snap)
+	d.add("round-coverage", "Percent", coverage*100.0)
+	complete := coverage >= c.MinCoverage
+	if !complete && c.IncompleteRoundPolicy == INCOMPLETE_ROUND_SKIP {
+		// only the coverage is pushed, not even the single hosts
+		snap.hosts = nil
+		return d, coverage
+	}
+	if c.MinCoverage > 0 {
+		flag := 1.0
+		if !complete {
+			flag = 0.0
+		}
+		d.add("round-complete", "Count", flag)
+	}
+	for _, m := range hostMetrics {
+		c.addHostMetric(d, m, snap)
+	}
+	addHealthMetrics(d, snap)
+	addEventMetrics(d, snap)
+	c.addCoreMetrics(d, snap)
+	addStatusMetrics(d, snap)
+	addAppMetrics(d, snap)
+	return d, coverage
+}
+
+func (c *CloudWatchPusher) push(r *u.Round, snap *snapshot, d *datapoints) {
+	for _, s := range c.sinks {
+		start := time.Now()
+		err := s.push(r, snap, d.data)
+		c.pushLatency[s.name()].ObserveDuration(time.Since(start))
+		c.pushLock.Lock()
+		c.pushes[s.name()] += 1
+		if err != nil {
+			c.pushFailures[s.name()] += 1
+		} else {
+			c.lastPush[s.name()] = time.Now()
+		}
+		c.pushLock.Unlock()
+		if err != nil {
+			c.log.Errorf("error pushing %s to the %s sink: %s", r, s.name(), err)
+		}
+	}
+}
+
+// SinkStats returns the totals of the pushes to every sink
+func (c *CloudWatchPusher) SinkStats() map[string]SinkStats {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	stats := make(map[string]SinkStats, len(c.sinks))
+	for _, s := range c.sinks {
+		name := s.name()
+		stats[name] = SinkStats{
+			Pushes:   c.pushes[name],
+			Failures: c.pushFailures[name],
+			Latency:  c.pushLatency[name].Snapshot(),
+			LastPush: c.lastPush[name],
+		}
+	}
+	return stats
+}
+
+// Dropped returns the number of rounds dropped because the pusher was
+// falling behind and the number of datapoints dropped from the retry queue
+func (c *CloudWatchPusher) Dropped() (rounds int64, datapoints int64) {
+	c.pushLock.Lock()
+	rounds = c.droppedRounds
+	c.pushLock.Unlock()
+	for _, s := range c.sinks {
+		if api, ok := s.(*apiSink); ok {
+			datapoints += int64(api.queue.Dropped())
+		}
+	}
+	return rounds, datapoints
+}
+
+// SetSelfMetrics sets the function providing the metrics about the poller
+// pushed with every round when SelfMetrics is set. it must be called before
+// Run
+func (c *CloudWatchPusher) SetSelfMetrics(f func(c *CloudWatchPusher) []SelfMetric) {
+	c.selfMetrics = f
+}
+
+// addSelfMetrics adds the metrics about the poller itself
+func (c *CloudWatchPusher) addSelfMetrics(d *datapoints) {
+	if !c.SelfMetrics || c.selfMetrics == nil {
+		return
+	}
+	for _, m := range c.selfMetrics(c) {
+		dimensions := make([]*cloudwatch.Dimension, 0, len(m.Dimensions))
+		for name, value := range m.Dimensions {
+			dimensions = append(dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(name),
+				Value: aws.String(value),
+			})
+		}
+		if m.Global {
+			d.addGlobal(m.Name, m.Unit, m.Value, dimensions...)
+			continue
+		}
+		d.add(m.Name, m.Unit, m.Value, dimensions...)
+	}
+}
+
+// LastPushes returns the time of the last successful push of every sink,
+// the creation time of the pusher for the sinks that never pushed
+func (c *CloudWatchPusher) LastPushes() map[string]time.Time {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	pushes := make(map[string]time.Time, len(c.lastPush))
+	for name, t := range c.lastPush {
+		pushes[name] = t
+	}
+	return pushes
+}
+
+// HandleStat records a new poll of a host. it is safe to be called from any
+// number of goroutines
 func (c *CloudWatchPusher) HandleStat(stat *u.UwsgiStats) {
-	id := stat.UniqueID()
-	c.hostLastSeen[id] = time.Now()
-	c.totalWorkers[id] = stat.TotalWorkers()
-	c.idleWorkers[id] = stat.IdleWorkers()
-	c.idleWorkersPercentage[id] = stat.IdleWorkersPercentage()
-	c.busyWorkers[id] = stat.BusyWorkers()
-	c.busyWorkersPercentage[id] = stat.BusyWorkersPercentage()
-	c.exceptionsCount[id] = stat.ExceptionsCount()
-}
-
-func New(key, secret, region, namespace, autoscalingGroupName string) (c *CloudWatchPusher, err error) {
-	creds := credentials.NewStaticCredentials(key, secret, "")
-	c = &CloudWatchPusher{
-		client:                cloudwatch.New(session.New(), aws.NewConfig().WithRegion(region).WithCredentials(creds)),
-		NameSpace:             namespace,
-		AutoscalingGroupName:  autoscalingGroupName,
-		totalWorkers:          make(map[string]float64),
-		idleWorkers:           make(map[string]float64),
-		idleWorkersPercentage: make(map[string]float64),
-		busyWorkers:           make(map[string]float64),
-		busyWorkersPercentage: make(map[string]float64),
-		exceptionsCount:       make(map[string]float64),
-		hostLastSeen:          make(map[string]time.Time),
-	}
-	err = c.checkClient()
+	c.store.update(stat, time.Now())
+}
+
+// HandleHealth records a change in the health state of a host reported by
+// the poller of the given generation
+func (c *CloudWatchPusher) HandleHealth(target string, generation int64, health int) {
+	c.store.setHealth(target, generation, health)
+}
+
+// HandleEvent makes the pusher an event handler: it counts the events by
+// reason and follows the health changes of the hosts
+func (c *CloudWatchPusher) HandleEvent(e *u.UwsgiEvent) {
+	c.store.countEvent(e.Reason.Name())
+	if e.Reason == u.HEALTH_CHANGED {
+		c.HandleHealth(e.Address, e.Generation, e.Health)
+	}
+}
+
+// RemoveHost immediately forgets a host that left discovery, it is not even
+// considered stale. the stats and events of its poller, of the given
+// generation, still on their way are ignored
+func (c *CloudWatchPusher) RemoveHost(target string, generation int64) {
+	c.store.remove(target, generation, time.Now())
+}
+
+// New creates a pusher with the sinks listed in the options, the CloudWatch
+// client and its credentials are only needed by the api sink
+func New(key, secret, region string, opts Options) (c *CloudWatchPusher, err error) {
+	var client cloudwatchiface.CloudWatchAPI
+	if opts.HasSink(SINK_API) {
+		creds := credentials.NewStaticCredentials(key, secret, "")
+		client = cloudwatch.New(session.New(), aws.NewConfig().WithRegion(region).WithCredentials(creds))
+	}
+	c, err = NewWithClient(client, opts)
 	if err != nil {
-		log.Printf("error creating cloudwatch client: %s", err)
 		return nil, err
 	}
-	log.Printf("created cloudwatch client for region %s", region)
-	go c.expireOldHosts()
+	if client != nil {
+		c.log.Infof("created cloudwatch client for region %s", region)
+	}
 	return c, nil
 }
 
-func (c *CloudWatchPusher) checkClient() (err error) {
-	params := &cloudwatch.ListMetricsInput{}
-	_, err = c.client.ListMetrics(params)
-	return err
+// NewWithClient creates a pusher whose api sink, if any, uses the given
+// implementation of the CloudWatch API, e.g. a local stand-in
+func NewWithClient(client cloudwatchiface.CloudWatchAPI, opts Options) (c *CloudWatchPusher, err error) {
+	c = &CloudWatchPusher{
+		Options:      opts,
+		log:          logger.With("group", opts.AutoscalingGroupName),
+		store:        newStore(),
+		rounds:       make(chan *u.Round, 10),
+		quit:         make(chan int),
+		done:         make(chan int),
+		lastPush:     make(map[string]time.Time),
+		pushLatency:  make(map[string]*u.Histogram),
+		pushes:       make(map[string]int64),
+		pushFailures: make(map[string]int64),
+	}
+	for _, kind := range opts.Sinks {
+		var s sink
+		switch kind {
+		case SINK_API:
+			s, err = newAPISink(client, opts)
+		case SINK_EMF:
+			s, err = newEMFSink(opts.EMFOutput, opts)
+		default:
+			err = fmt.Errorf("unknown sink %d", kind)
+		}
+		if err != nil {
+			c.closeSinks(context.Background())
+			return nil, err
+		}
+		c.sinks = append(c.sinks, s)
+		c.lastPush[s.name()] = time.Now()
+		c.pushLatency[s.name()] = u.NewHistogram(u.LatencyBuckets)
+	}
+	if len(c.sinks) == 0 {
+		return nil, fmt.Errorf("no sink configured")
+	}
+	return c, nil
 }
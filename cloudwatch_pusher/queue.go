@@ -0,0 +1,304 @@
+package cloudwatch_pusher
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	// cloudWatchMaxAge is the oldest timestamp CloudWatch accepts for a
+	// datapoint, older ones are rejected and there is no point in replaying
+	// them
+	cloudWatchMaxAge = 14 * 24 * time.Hour
+)
+
+// queuedDatum is a datapoint that failed to be pushed, it keeps its original
+// timestamp so that once replayed it lands where it belongs. Seq identifies
+// it within the queue. a line of the queue file with Removed set and no
+// datapoint is a tombstone listing the datapoints that left the queue
+type queuedDatum struct {
+	Seq       int64
+	Namespace string                  `json:",omitempty"`
+	Datum     *cloudwatch.MetricDatum `json:",omitempty"`
+	Removed   []int64                 `json:",omitempty"`
+}
+
+// retryQueue holds the datapoints waiting to be pushed again. when path is
+// set every datapoint is appended to it as a json line as soon as it is
+// queued and a tombstone is appended once datapoints leave the queue, so
+// that they survive a restart. the file is compacted once it holds more
+// dead lines than queued datapoints. the queue is bounded, once full the
+// oldest datapoints are dropped
+type retryQueue struct {
+	sync.Mutex
+	path    string
+	size    int
+	maxAge  time.Duration
+	entries []*queuedDatum
+	nextSeq int64
+	// garbage is the number of lines of the file that are tombstones or
+	// datapoints no longer queued
+	garbage int
+	dropped int
+}
+
+func newRetryQueue(path string, size int, maxAge time.Duration) (q *retryQueue, err error) {
+	if maxAge <= 0 || maxAge > cloudWatchMaxAge {
+		maxAge = cloudWatchMaxAge
+	}
+	q = &retryQueue{
+		path:    path,
+		size:    size,
+		maxAge:  maxAge,
+		nextSeq: 1,
+	}
+	if path == "" {
+		return q, nil
+	}
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(q.entries) > 0 {
+		logger.Infof("loaded %d datapoints to retry from %s", len(q.entries), path)
+	}
+	return q, nil
+}
+
+// load reads the queue back from disk. lines that cannot be decoded, e.g.
+// one half written when the process died, are skipped
+func (q *retryQueue) load() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	removed := make(map[int64]bool)
+	entries := make([]*queuedDatum, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &queuedDatum{}
+		err := json.Unmarshal(scanner.Bytes(), e)
+		if err != nil || (e.Datum == nil && e.Removed == nil) {
+			logger.Warnf("skipping invalid datapoint in %s: %s", q.path, scanner.Text())
+			continue
+		}
+		for _, seq := range e.Removed {
+			removed[seq] = true
+		}
+		if e.Datum != nil {
+			entries = append(entries, e)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if removed[e.Seq] {
+			continue
+		}
+		q.entries = append(q.entries, e)
+		if e.Seq >= q.nextSeq {
+			q.nextSeq = e.Seq + 1
+		}
+	}
+	q.trim()
+	// the tombstones read are not needed anymore
+	if len(removed) > 0 {
+		q.save()
+	}
+	return nil
+}
+
+// trim drops the oldest datapoints of a queue grown over its size
+func (q *retryQueue) trim() {
+	if q.size <= 0 || len(q.entries) <= q.size {
+		return
+	}
+	drop := len(q.entries) - q.size
+	gone := q.entries[:drop]
+	q.entries = q.entries[drop:]
+	q.discard(gone)
+	q.dropped += drop
+	logger.Warnf("retry queue is full, dropped the %d oldest datapoints", drop)
+}
+
+// push queues a datapoint
+func (q *retryQueue) push(namespace string, datum *cloudwatch.MetricDatum) {
+	q.Lock()
+	defer q.Unlock()
+	e := &queuedDatum{
+		Seq:       q.nextSeq,
+		Namespace: namespace,
+		Datum:     datum,
+	}
+	q.nextSeq += 1
+	q.entries = append(q.entries, e)
+	q.append(e)
+	q.trim()
+}
+
+// peek returns up to n of the oldest datapoints of the same namespace,
+// dropping first the ones too old to be accepted by CloudWatch
+func (q *retryQueue) peek(n int, now time.Time) []*queuedDatum {
+	q.Lock()
+	defer q.Unlock()
+	deadline := now.Add(-q.maxAge)
+	expired := 0
+	for expired < len(q.entries) && q.entries[expired].Datum.Timestamp != nil && q.entries[expired].Datum.Timestamp.Before(deadline) {
+		expired += 1
+	}
+	if expired > 0 {
+		logger.Warnf("dropping %d datapoints older than %s from the retry queue", expired, q.maxAge)
+		gone := q.entries[:expired]
+		q.entries = q.entries[expired:]
+		q.discard(gone)
+		q.dropped += expired
+	}
+	batch := make([]*queuedDatum, 0, n)
+	for _, e := range q.entries {
+		if len(batch) == n || (len(batch) > 0 && e.Namespace != batch[0].Namespace) {
+			break
+		}
+		batch = append(batch, e)
+	}
+	return batch
+}
+
+// remove takes the given datapoints out of the queue once pushed. those
+// already dropped meanwhile, e.g. because the queue was full, are ignored.
+// it returns how many were still queued
+func (q *retryQueue) remove(batch []*queuedDatum) int {
+	q.Lock()
+	defer q.Unlock()
+	seqs := make(map[int64]bool, len(batch))
+	for _, e := range batch {
+		seqs[e.Seq] = true
+	}
+	left := make([]*queuedDatum, 0, len(q.entries))
+	gone := make([]*queuedDatum, 0, len(batch))
+	for _, e := range q.entries {
+		if seqs[e.Seq] {
+			gone = append(gone, e)
+			continue
+		}
+		left = append(left, e)
+	}
+	q.entries = left
+	q.discard(gone)
+	return len(gone)
+}
+
+// drop takes out of the queue datapoints that cannot be pushed, counting
+// them as dropped
+func (q *retryQueue) drop(batch []*queuedDatum) {
+	q.addDropped(q.remove(batch))
+}
+
+// addDropped counts datapoints dropped without being queued
+func (q *retryQueue) addDropped(n int) {
+	q.Lock()
+	q.dropped += n
+	q.Unlock()
+}
+
+// discard records that datapoints left the queue, appending a tombstone to
+// the file or compacting it once it holds more dead lines than datapoints.
+// they must already be out of the entries, a compaction writes what is left
+func (q *retryQueue) discard(gone []*queuedDatum) {
+	if q.path == "" || len(gone) == 0 {
+		return
+	}
+	q.garbage += len(gone) + 1
+	if q.garbage > len(q.entries) {
+		q.save()
+		return
+	}
+	tombstone := &queuedDatum{Removed: make([]int64, 0, len(gone))}
+	for _, e := range gone {
+		tombstone.Removed = append(tombstone.Removed, e.Seq)
+	}
+	q.append(tombstone)
+}
+
+// Len returns the number of datapoints waiting to be pushed again
+func (q *retryQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.entries)
+}
+
+// Dropped returns the number of datapoints dropped since the start because
+// the queue was full or they got too old
+func (q *retryQueue) Dropped() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
+
+// append writes a single datapoint at the end of the queue file
+func (q *retryQueue) append(e *queuedDatum) {
+	if q.path == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("error encoding datapoint for the retry queue: %s", err)
+		return
+	}
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		logger.Errorf("error opening retry queue %s: %s", q.path, err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		logger.Errorf("error writing retry queue %s: %s", q.path, err)
+	}
+}
+
+// save rewrites the whole queue file. it is written aside and renamed over
+// the old one so that a crash never leaves a partial queue behind
+func (q *retryQueue) save() {
+	if q.path == "" {
+		return
+	}
+	tmp, err := os.Create(filepath.Join(filepath.Dir(q.path), "."+filepath.Base(q.path)+".tmp"))
+	if err != nil {
+		logger.Errorf("error saving retry queue %s: %s", q.path, err)
+		return
+	}
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, e := range q.entries {
+		err = encoder.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path)
+	}
+	if err != nil {
+		logger.Errorf("error saving retry queue %s: %s", q.path, err)
+		os.Remove(tmp.Name())
+		return
+	}
+	q.garbage = 0
+}
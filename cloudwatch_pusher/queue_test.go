@@ -0,0 +1,204 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func newDatum(i int) *cloudwatch.MetricDatum {
+	return &cloudwatch.MetricDatum{
+		MetricName: aws.String(fmt.Sprintf("metric-%d", i)),
+		Value:      aws.Float64(float64(i)),
+		Timestamp:  aws.Time(time.Now()),
+	}
+}
+
+// names returns the metric names of the queued datapoints, oldest first
+func names(q *retryQueue) []string {
+	q.Lock()
+	defer q.Unlock()
+	names := make([]string, 0, len(q.entries))
+	for _, e := range q.entries {
+		names = append(names, aws.StringValue(e.Datum.MetricName))
+	}
+	return names
+}
+
+func checkNames(t *testing.T, q *retryQueue, from, to int) {
+	got := names(q)
+	if len(got) != to-from {
+		t.Fatalf("expected %d queued datapoints, got %d: %v", to-from, len(got), got)
+	}
+	for i, name := range got {
+		if name != fmt.Sprintf("metric-%d", from+i) {
+			t.Fatalf("expected metric-%d at %d, got %s", from+i, i, name)
+		}
+	}
+}
+
+func tempQueuePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "retry-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "queue"), func() { os.RemoveAll(dir) }
+}
+
+func TestRetryQueueTrim(t *testing.T) {
+	q, _ := newRetryQueue("", 5, 0)
+	for i := 0; i < 8; i++ {
+		q.push("ns", newDatum(i))
+	}
+	checkNames(t, q, 3, 8)
+	if q.Dropped() != 3 {
+		t.Fatalf("expected 3 dropped datapoints, got %d", q.Dropped())
+	}
+}
+
+func TestRetryQueueRemoveAfterTrim(t *testing.T) {
+	q, _ := newRetryQueue("", 5, 0)
+	for i := 0; i < 5; i++ {
+		q.push("ns", newDatum(i))
+	}
+	batch := q.peek(3, time.Now())
+	// the queue fills up while the batch is being pushed, dropping part of
+	// it: removing the batch must not take out what was not sent
+	for i := 5; i < 7; i++ {
+		q.push("ns", newDatum(i))
+	}
+	q.remove(batch)
+	checkNames(t, q, 3, 7)
+}
+
+func TestRetryQueueExpired(t *testing.T) {
+	q, _ := newRetryQueue("", 0, time.Hour)
+	old := newDatum(0)
+	old.Timestamp = aws.Time(time.Now().Add(-2 * time.Hour))
+	q.push("ns", old)
+	q.push("ns", newDatum(1))
+	batch := q.peek(10, time.Now())
+	if len(batch) != 1 || aws.StringValue(batch[0].Datum.MetricName) != "metric-1" {
+		t.Fatalf("expected only the recent datapoint, got %d", len(batch))
+	}
+	if q.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped datapoint, got %d", q.Dropped())
+	}
+}
+
+func TestRetryQueueReload(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, err := newRetryQueue(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		q.push("ns", newDatum(i))
+	}
+	q.remove(q.peek(4, time.Now()))
+	q.push("ns", newDatum(10))
+
+	q, err = newRetryQueue(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, q, 4, 11)
+	// datapoints queued after the restart do not clash with the reloaded
+	// ones
+	q.push("ns", newDatum(11))
+	q.remove(q.peek(2, time.Now()))
+	q, err = newRetryQueue(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, q, 6, 12)
+}
+
+func TestRetryQueueReloadTrims(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, _ := newRetryQueue(path, 0, 0)
+	for i := 0; i < 10; i++ {
+		q.push("ns", newDatum(i))
+	}
+	q, err := newRetryQueue(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, q, 6, 10)
+}
+
+func TestRetryQueueCompacts(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, _ := newRetryQueue(path, 0, 0)
+	for i := 0; i < 1000; i++ {
+		q.push("ns", newDatum(i))
+		if i%2 == 1 {
+			q.remove(q.peek(1, time.Now()))
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, b := range data {
+		if b == '\n' {
+			lines += 1
+		}
+	}
+	// the file never holds more dead lines than queued datapoints
+	if lines > 2*q.Len()+2 {
+		t.Fatalf("expected the file to be compacted, %d lines for %d datapoints", lines, q.Len())
+	}
+	q, _ = newRetryQueue(path, 0, 0)
+	checkNames(t, q, 500, 1000)
+}
+
+func TestRetryQueueTrimCompacts(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, _ := newRetryQueue(path, 5, 0)
+	for i := 0; i < 20; i++ {
+		q.push("ns", newDatum(i))
+	}
+	checkNames(t, q, 15, 20)
+	// reloaded without a bound, nothing trimmed before may come back
+	q, err := newRetryQueue(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, q, 15, 20)
+}
+
+func TestRetryQueueExpiryCompacts(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, _ := newRetryQueue(path, 0, time.Hour)
+	for i := 0; i < 7; i++ {
+		datum := newDatum(i)
+		if i < 3 {
+			datum.Timestamp = aws.Time(time.Now().Add(-2 * time.Hour))
+		}
+		q.push("ns", datum)
+	}
+	// dead lines pile up so that dropping the expired datapoints compacts
+	// the file
+	q.remove(q.entries[6:])
+	q.remove(q.entries[5:])
+	q.peek(10, time.Now())
+	checkNames(t, q, 3, 5)
+	q, err := newRetryQueue(path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, q, 3, 5)
+}
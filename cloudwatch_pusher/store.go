@@ -0,0 +1,373 @@
+package cloudwatch_pusher
+
+import (
+	"sync"
+	"time"
+
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+// hostState is everything known about a single host as of its last poll
+type hostState struct {
+	target   string
+	labels   map[string]string
+	lastSeen time.Time
+	round    int64
+	stale    bool
+	// zero is set on a stale host counted with zero values, it has no
+	// percentage to report
+	zero                  bool
+	totalWorkers          float64
+	activeWorkers         float64
+	idleWorkers           float64
+	busyWorkers           float64
+	exceptionsCount       float64
+	busyWorkersPercentage float64
+	idleWorkersPercentage float64
+	totalCores            float64
+	busyCores             float64
+	saturationBusy        float64
+	saturationCapacity    float64
+	// harakiriCount and respawnCount count events since the last push
+	harakiriCount float64
+	respawnCount  float64
+	statusCounts  map[string]float64
+	apps          map[string]*appMetrics
+	appLastSample map[string]*appSample
+	// stats is the last poll of the host as it was received
+	stats *u.UwsgiStats
+}
+
+// appSample is the last set of counters seen for an app on a host, used as
+// the baseline to turn the ever increasing uwsgi counters into rates
+type appSample struct {
+	requests   float64
+	exceptions float64
+	seen       time.Time
+}
+
+type appMetrics struct {
+	rated          bool
+	requestsRate   float64
+	exceptionsRate float64
+	startupTime    float64
+}
+
+func (h *hostState) copy() *hostState {
+	c := *h
+	c.statusCounts = make(map[string]float64, len(h.statusCounts))
+	for status, count := range h.statusCounts {
+		c.statusCounts[status] = count
+	}
+	c.apps = make(map[string]*appMetrics, len(h.apps))
+	for name, app := range h.apps {
+		a := *app
+		c.apps[name] = &a
+	}
+	// the baselines are only ever needed by the store itself
+	c.appLastSample = nil
+	return &c
+}
+
+// store holds the state of all the hosts. it is written by HandleStat from
+// the stats goroutine and read by the push loop, every access goes through
+// its lock
+type store struct {
+	sync.Mutex
+	hosts map[string]*hostState
+	// previous holds the sample of the round before the current one, a host
+	// polled early in a round may report before the previous round is pushed
+	previous map[string]*hostState
+	// health is tracked apart from the host state since a host that is down
+	// does not send stats but must still be counted
+	health map[string]int
+	// events counts the poller events by reason since the last push
+	events map[string]float64
+	// removed holds the hosts that left discovery, so that the stats and
+	// health changes of their pollers still in flight do not bring them
+	// back
+	removed map[string]*removal
+}
+
+// removal is the generation of the poller of a host that left discovery and
+// the time it left
+type removal struct {
+	generation int64
+	at         time.Time
+}
+
+// snapshot is a consistent copy of the store for a collection round, safe
+// to be read without any locking. it holds the hosts that reported in the
+// round and, depending on the stale policy, the ones that did not
+type snapshot struct {
+	taken time.Time
+	round int64
+	hosts map[string]*hostState
+	// reported is the number of hosts that reported in the round, stale the
+	// number of hosts that did not but are still within their grace and
+	// expired the hosts forgotten because their grace ran out
+	reported int
+	stale    int
+	expired  []string
+	health   map[string]int
+	events   map[string]float64
+}
+
+func newStore() *store {
+	return &store{
+		hosts:    make(map[string]*hostState),
+		previous: make(map[string]*hostState),
+		health:   make(map[string]int),
+		events:   make(map[string]float64),
+		removed:  make(map[string]*removal),
+	}
+}
+
+func (s *store) countEvent(reason string) {
+	s.Lock()
+	defer s.Unlock()
+	s.events[reason] += 1.0
+}
+
+func (s *store) setHealth(target string, generation int64, health int) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.current(target, generation) {
+		return
+	}
+	s.health[target] = health
+}
+
+// remove forgets everything about a host that left discovery, polled up to
+// the given poller generation
+func (s *store) remove(target string, generation int64, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.hosts, target)
+	delete(s.previous, target)
+	delete(s.health, target)
+	s.removed[target] = &removal{generation: generation, at: now}
+}
+
+// current tells whether data from the poller of the given generation is
+// about a host still discovered: a host removed is only brought back by a
+// newer poller
+func (s *store) current(target string, generation int64) bool {
+	r, ok := s.removed[target]
+	if !ok {
+		return true
+	}
+	if generation > r.generation {
+		delete(s.removed, target)
+		return true
+	}
+	return false
+}
+
+// update records a new poll of a host
+func (s *store) update(stat *u.UwsgiStats, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	id := stat.ID()
+	if !s.current(id, stat.Generation) {
+		return
+	}
+	h, ok := s.hosts[id]
+	if !ok {
+		h = &hostState{
+			target: id,
+		}
+		s.hosts[id] = h
+	} else if h.round < stat.Round {
+		prev := h.copy()
+		// the counters keep accumulating on the current sample
+		prev.harakiriCount = 0
+		prev.respawnCount = 0
+		s.previous[id] = prev
+	}
+	// a host sending stats is up, even before its poller reports any change
+	// in health
+	s.health[id] = u.HEALTH_UP
+	h.labels = stat.Labels
+	h.lastSeen = now
+	h.round = stat.Round
+	h.totalWorkers = stat.TotalWorkers()
+	h.activeWorkers = stat.ActiveWorkers()
+	h.idleWorkers = stat.IdleWorkers()
+	h.busyWorkers = stat.BusyWorkers()
+	h.exceptionsCount = stat.ExceptionsCount()
+	h.busyWorkersPercentage = stat.BusyWorkersPercentage()
+	h.idleWorkersPercentage = stat.IdleWorkersPercentage()
+	h.totalCores = stat.TotalCores()
+	h.busyCores = stat.BusyCores()
+	h.saturationBusy, h.saturationCapacity = stat.Saturation()
+	h.harakiriCount += stat.Harakiris()
+	h.respawnCount += stat.Respawns()
+	h.statusCounts = stat.StatusCounts()
+	h.stats = stat
+	h.updateApps(stat, now)
+}
+
+// updateApps computes the per app rates for a host against the previous
+// sample. an app seen for the first time, or whose counters were reset by a
+// master restart, only gets a baseline and no rate
+func (h *hostState) updateApps(stat *u.UwsgiStats, now time.Time) {
+	previous := h.appLastSample
+	if stat.MasterRestarted {
+		previous = nil
+	}
+	samples := make(map[string]*appSample)
+	metrics := make(map[string]*appMetrics)
+	for name, app := range stat.Apps() {
+		samples[name] = &appSample{
+			requests:   app.Requests,
+			exceptions: app.Exceptions,
+			seen:       now,
+		}
+		m := &appMetrics{
+			startupTime: app.StartupTime,
+		}
+		if prev, ok := previous[name]; ok {
+			elapsed := now.Sub(prev.seen).Seconds()
+			if elapsed > 0 && app.Requests >= prev.requests && app.Exceptions >= prev.exceptions {
+				m.rated = true
+				m.requestsRate = (app.Requests - prev.requests) / elapsed
+				m.exceptionsRate = (app.Exceptions - prev.exceptions) / elapsed
+			}
+		}
+		metrics[name] = m
+	}
+	h.appLastSample = samples
+	h.apps = metrics
+}
+
+// zeroed returns a copy of the host keeping only its identity
+func (h *hostState) zeroed() *hostState {
+	return &hostState{
+		zero:         true,
+		target:       h.target,
+		labels:       h.labels,
+		lastSeen:     h.lastSeen,
+		round:        h.round,
+		statusCounts: make(map[string]float64),
+		apps:         make(map[string]*appMetrics),
+	}
+}
+
+// snapshot copies the state of the hosts that reported in a round and, in
+// the same critical section, resets their counters of events since the last
+// push so that no event is counted twice or lost between the copy and the
+// reset. a host that did not report in the round but was seen after
+// staleDeadline is stale and is excluded, zeroed or carried forward with its
+// last sample depending on stalePolicy, a host not seen since before
+// staleDeadline is forgotten. a preview snapshot leaves the store untouched
+func (s *store) snapshot(now time.Time, round int64, staleDeadline time.Time, stalePolicy int, preview bool) *snapshot {
+	s.Lock()
+	defer s.Unlock()
+	snap := &snapshot{
+		round:  round,
+		hosts:  make(map[string]*hostState, len(s.hosts)),
+		health: make(map[string]int, len(s.health)),
+		events: s.events,
+	}
+	if preview {
+		snap.events = make(map[string]float64, len(s.events))
+		for reason, n := range s.events {
+			snap.events[reason] = n
+		}
+	} else {
+		s.events = make(map[string]float64)
+	}
+	for target, health := range s.health {
+		snap.health[target] = health
+	}
+	if !preview {
+		s.forgetRemovals(staleDeadline)
+	}
+	for id, h := range s.hosts {
+		var sample *hostState
+		if h.round == round {
+			sample = h.copy()
+		} else if prev, ok := s.previous[id]; ok && prev.round == round {
+			sample = prev.copy()
+			sample.harakiriCount = h.harakiriCount
+			sample.respawnCount = h.respawnCount
+		} else if h.lastSeen.Before(staleDeadline) {
+			if !preview {
+				delete(s.hosts, id)
+				delete(s.previous, id)
+			}
+			snap.expired = append(snap.expired, id)
+			continue
+		} else {
+			snap.stale += 1
+			switch stalePolicy {
+			case STALE_CARRY_FORWARD:
+				sample = h.copy()
+			case STALE_ZERO:
+				sample = h.zeroed()
+			default:
+				continue
+			}
+			sample.stale = true
+			snap.hosts[id] = sample
+			if stalePolicy == STALE_CARRY_FORWARD && !preview {
+				h.harakiriCount = 0
+				h.respawnCount = 0
+			}
+			continue
+		}
+		snap.reported += 1
+		snap.hosts[id] = sample
+		if !preview {
+			h.harakiriCount = 0
+			h.respawnCount = 0
+		}
+	}
+	return snap
+}
+
+// restore gives the counters of events taken by a snapshot back to the
+// store, when the snapshot is not pushed, so that the next one counts them
+func (s *store) restore(snap *snapshot) {
+	s.Lock()
+	defer s.Unlock()
+	for reason, n := range snap.events {
+		s.events[reason] += n
+	}
+	for id, sample := range snap.hosts {
+		if h, ok := s.hosts[id]; ok {
+			h.harakiriCount += sample.harakiriCount
+			h.respawnCount += sample.respawnCount
+		}
+	}
+}
+
+// forgetRemovals forgets the hosts removed before staleDeadline: late data
+// of a removed host arrives within a round, the removals are remembered as
+// long as a stale host would be
+func (s *store) forgetRemovals(staleDeadline time.Time) {
+	for target, r := range s.removed {
+		if r.at.Before(staleDeadline) {
+			delete(s.removed, target)
+		}
+	}
+}
+
+// sum adds up a value across all the hosts of the snapshot
+func (s *snapshot) sum(value func(h *hostState) float64) (total float64) {
+	for _, h := range s.hosts {
+		total += value(h)
+	}
+	return total
+}
+
+// countHealth returns the number of hosts in the given health state
+func (s *snapshot) countHealth(health int) (n float64) {
+	for _, h := range s.health {
+		if h == health {
+			n += 1.0
+		}
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+package cloudwatch_pusher
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	u "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+func newStat(target string, generation, round int64) *u.UwsgiStats {
+	return &u.UwsgiStats{
+		Target:     target,
+		Generation: generation,
+		Round:      round,
+	}
+}
+
+func TestStoreConcurrentAccess(t *testing.T) {
+	s := newStore()
+	var wg sync.WaitGroup
+	for p := 0; p < 16; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			target := fmt.Sprintf("host-%d", p%4)
+			generation := int64(p)
+			for round := int64(1); round <= 200; round++ {
+				s.update(newStat(target, generation, round), time.Now())
+				s.setHealth(target, generation, u.HEALTH_UP)
+				s.countEvent("restart")
+				if round%50 == 0 {
+					s.remove(target, generation, time.Now())
+				}
+			}
+		}(p)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for round := int64(1); round <= 200; round++ {
+				snap := s.snapshot(time.Now(), round, time.Now().Add(-time.Millisecond), i%3, i%2 == 0)
+				snap.sum(func(h *hostState) float64 { return h.totalWorkers })
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStoreSnapshotIsACopy(t *testing.T) {
+	s := newStore()
+	now := time.Now()
+	s.update(newStat("host", 1, 1), now)
+	snap := s.snapshot(now, 1, now.Add(-time.Minute), STALE_EXCLUDE, false)
+	s.update(newStat("other", 1, 1), now)
+	s.snapshot(now, 2, now.Add(time.Second), STALE_EXCLUDE, false)
+	if len(snap.hosts) != 1 || snap.hosts["host"] == nil {
+		t.Fatalf("expected the snapshot to keep its own copy of the hosts, got %v", snap.hosts)
+	}
+}
+
+func TestStoreIgnoresRemovedHost(t *testing.T) {
+	s := newStore()
+	now := time.Now()
+	s.update(newStat("host", 1, 1), now)
+	s.remove("host", 1, now)
+	s.update(newStat("host", 1, 2), now)
+	s.setHealth("host", 1, u.HEALTH_DOWN)
+	snap := s.snapshot(now, 2, now.Add(-time.Minute), STALE_CARRY_FORWARD, false)
+	if len(snap.hosts) != 0 || len(snap.health) != 0 {
+		t.Fatalf("expected the late data of a removed host to be ignored, got %v %v", snap.hosts, snap.health)
+	}
+	s.update(newStat("host", 2, 3), now)
+	snap = s.snapshot(now, 3, now.Add(-time.Minute), STALE_CARRY_FORWARD, false)
+	if snap.reported != 1 {
+		t.Fatalf("expected the host polled again to be reported, got %d", snap.reported)
+	}
+}
+
+func TestStoreForgetsRemovals(t *testing.T) {
+	s := newStore()
+	now := time.Now()
+	s.remove("host", 1, now.Add(-time.Hour))
+	s.snapshot(now, 1, now.Add(-time.Minute), STALE_EXCLUDE, true)
+	if len(s.removed) != 1 {
+		t.Fatalf("expected a preview snapshot to keep the removals")
+	}
+	s.snapshot(now, 1, now.Add(-time.Minute), STALE_EXCLUDE, false)
+	if len(s.removed) != 0 {
+		t.Fatalf("expected the removal to be forgotten, got %v", s.removed)
+	}
+}
+
+func TestStoreRestoresCounters(t *testing.T) {
+	s := newStore()
+	now := time.Now()
+	s.update(newStat("host", 1, 1), now)
+	s.hosts["host"].harakiriCount = 2
+	s.countEvent("restart")
+	snap := s.snapshot(now, 1, now.Add(-time.Minute), STALE_EXCLUDE, false)
+	s.restore(snap)
+	s.update(newStat("host", 1, 2), now)
+	snap = s.snapshot(now, 2, now.Add(-time.Minute), STALE_EXCLUDE, false)
+	if snap.events["restart"] != 1 || snap.hosts["host"].harakiriCount != 2 {
+		t.Fatalf("expected the counters of the skipped snapshot in the next one, got %v %f", snap.events, snap.hosts["host"].harakiriCount)
+	}
+}
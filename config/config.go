@@ -0,0 +1,328 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the poller. it is first filled from the
+// command line flags, then from the configuration file and finally from the
+// environment, each one overriding the previous
+type Config struct {
+	Debug       bool              `yaml:"debug"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Polling     PollingConfig     `yaml:"polling"`
+	Events      EventsConfig      `yaml:"events"`
+	AWS         AWSConfig         `yaml:"aws"`
+	Sinks       []SinkConfig      `yaml:"sinks"`
+	Aggregation AggregationConfig `yaml:"aggregation"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Logging     LogConfig         `yaml:"logging"`
+	// ShutdownTimeout bounds the time spent draining the polls and flushing
+	// the sinks on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type DiscoveryConfig struct {
+	Etcd EtcdConfig `yaml:"etcd"`
+	// StatsPort is the port of the uwsgi stats server of the discovered hosts
+	StatsPort int `yaml:"stats_port"`
+}
+
+type EtcdConfig struct {
+	Hosts  []string      `yaml:"hosts"`
+	Dirs   []string      `yaml:"dirs"`
+	Period time.Duration `yaml:"period"`
+	// KeepHostsOnError keeps polling the last known hosts of a directory
+	// while etcd cannot be read
+	KeepHostsOnError bool          `yaml:"keep_hosts_on_error"`
+	KeyQuarantine    time.Duration `yaml:"key_quarantine"`
+}
+
+type PollingConfig struct {
+	Period                time.Duration `yaml:"period"`
+	MaxConcurrentPolls    int           `yaml:"max_concurrent_polls"`
+	Jitter                time.Duration `yaml:"jitter"`
+	RoundGrace            time.Duration `yaml:"round_grace"`
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	ReadTimeout           time.Duration `yaml:"read_timeout"`
+	MaxPayloadSize        int64         `yaml:"max_payload_size"`
+	FailureThreshold      int           `yaml:"failure_threshold"`
+	Backoff               BackoffConfig `yaml:"backoff"`
+	ParseErrorPolicy      string        `yaml:"parse_error_policy"`
+	MaxParseBackoff       time.Duration `yaml:"max_parse_backoff"`
+	QuarantinePeriod      time.Duration `yaml:"quarantine_period"`
+	BadPayloadDir         string        `yaml:"bad_payload_dir"`
+	AvailableWorkerStates []string      `yaml:"available_worker_states"`
+	InactiveWorkerStates  []string      `yaml:"inactive_worker_states"`
+}
+
+type BackoffConfig struct {
+	Initial time.Duration `yaml:"initial"`
+	Max     time.Duration `yaml:"max"`
+	Jitter  float64       `yaml:"jitter"`
+}
+
+type EventsConfig struct {
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+type WebhookConfig struct {
+	URL     string        `yaml:"url"`
+	Reasons []string      `yaml:"reasons"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type AWSConfig struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Region    string `yaml:"region"`
+	Namespace string `yaml:"namespace"`
+}
+
+// SinkConfig configures a sink, the retry settings only apply to the api
+// sink and the output only to the emf one
+type SinkConfig struct {
+	Type            string        `yaml:"type"`
+	Output          string        `yaml:"output"`
+	RetryQueue      string        `yaml:"retry_queue"`
+	RetryQueueSize  int           `yaml:"retry_queue_size"`
+	RetryMaxAge     time.Duration `yaml:"retry_max_age"`
+	RetryBackoffMax time.Duration `yaml:"retry_backoff_max"`
+}
+
+type AggregationConfig struct {
+	Groups          []GroupConfig `yaml:"groups"`
+	PerHostMetrics  bool          `yaml:"per_host_metrics"`
+	MinCoverage     float64       `yaml:"min_coverage"`
+	IncompleteRound string        `yaml:"incomplete_round"`
+	StaleGrace      time.Duration `yaml:"stale_grace"`
+	StalePolicy     string        `yaml:"stale_policy"`
+	HostStatistics  []string      `yaml:"host_statistics"`
+	HostValues      string        `yaml:"host_values"`
+	HighResolution  bool          `yaml:"high_resolution"`
+	SelfMetrics     bool          `yaml:"self_metrics"`
+}
+
+// AdminConfig configures the admin http server, it is disabled when Listen
+// is empty. Token is required by the requests changing the state of the
+// poller, it must be set unless the server only listens on loopback.
+// HealthMissedIntervals is how many polling or etcd periods can go by
+// without a successful push or etcd read before the poller is unhealthy
+type AdminConfig struct {
+	Listen                string `yaml:"listen"`
+	Token                 string `yaml:"token"`
+	HealthMissedIntervals int    `yaml:"health_missed_intervals"`
+}
+
+// LogConfig configures the logging: Level is the default level, Levels
+// the level of single components and RateLimit how long the repeated
+// warnings and errors about a host are suppressed, 0 to log them all
+type LogConfig struct {
+	Format    string            `yaml:"format"`
+	Level     string            `yaml:"level"`
+	Levels    map[string]string `yaml:"levels"`
+	RateLimit time.Duration     `yaml:"rate_limit"`
+}
+
+// GroupConfig is an aggregation group: the hosts discovered in its etcd
+// directories are aggregated together and pushed with its name as the
+// AutoscalingGroupName dimension. a group with no directory gets all the
+// directories not claimed by another group
+type GroupConfig struct {
+	Name     string   `yaml:"name"`
+	EtcdDirs []string `yaml:"etcd_dirs"`
+}
+
+// Load overrides the configuration with the content of the given file, if
+// any, and with the environment, then validates it. every problem found is
+// reported along with the line of the file it comes from
+func Load(path string, c *Config) error {
+	root := &yaml.Node{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = decode(path, data, c)
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(data, root)
+		if err != nil {
+			return err
+		}
+	}
+	errs := applyEnv(c)
+	c.setDefaults()
+	errs = append(errs, c.validate()...)
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, e := range errs {
+		e.File = path
+		e.Line = lineOf(root, e.Path)
+	}
+	return errs
+}
+
+// setDefaults fills the settings of the sinks left out of the file
+func (c *Config) setDefaults() {
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		if s.RetryQueueSize == 0 {
+			s.RetryQueueSize = cw.DefaultOptions.RetryQueueSize
+		}
+		if s.RetryMaxAge == 0 {
+			s.RetryMaxAge = cw.DefaultOptions.RetryMaxAge
+		}
+		if s.RetryBackoffMax == 0 {
+			s.RetryBackoffMax = cw.DefaultOptions.RetryBackoff.Max
+		}
+		if s.Output == "" {
+			s.Output = cw.DefaultOptions.EMFOutput
+		}
+	}
+}
+
+// decode strictly decodes the file, a key that is not part of the
+// configuration is an error rather than being silently ignored
+func decode(path string, data []byte, c *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(c)
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	terr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	errs := make(ValidationErrors, 0, len(terr.Errors))
+	for _, msg := range terr.Errors {
+		e := &ValidationError{
+			File: path,
+			Msg:  msg,
+		}
+		// the yaml errors already start with the line they refer to
+		var line int
+		_, serr := fmt.Sscanf(msg, "line %d:", &line)
+		if serr == nil {
+			e.Line = line
+			e.Msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// PollerOptions returns the options of the uwsgi pollers
+func (c *Config) PollerOptions() uwsgi.Options {
+	policy, _ := uwsgi.ParseErrorPolicyFromString(c.Polling.ParseErrorPolicy)
+	return uwsgi.Options{
+		DialTimeout:      c.Polling.DialTimeout,
+		ReadTimeout:      c.Polling.ReadTimeout,
+		MaxPayloadSize:   c.Polling.MaxPayloadSize,
+		FailureThreshold: c.Polling.FailureThreshold,
+		Backoff: uwsgi.Backoff{
+			Initial:    c.Polling.Backoff.Initial,
+			Max:        c.Polling.Backoff.Max,
+			Multiplier: uwsgi.DefaultOptions.Backoff.Multiplier,
+			Jitter:     c.Polling.Backoff.Jitter,
+		},
+		ParseErrorPolicy: policy,
+		MaxParseBackoff:  c.Polling.MaxParseBackoff,
+		QuarantinePeriod: c.Polling.QuarantinePeriod,
+		BadPayloadDir:    c.Polling.BadPayloadDir,
+	}
+}
+
+// PusherOptions returns the options of the pusher of an aggregation group.
+// when there are several groups each one gets its own retry queue file
+func (c *Config) PusherOptions(group GroupConfig) cw.Options {
+	incompleteRound, _ := cw.IncompleteRoundPolicyFromString(c.Aggregation.IncompleteRound)
+	stalePolicy, _ := cw.StalePolicyFromString(c.Aggregation.StalePolicy)
+	hostValues, _ := cw.HostValuesModeFromString(c.Aggregation.HostValues)
+	opts := cw.DefaultOptions
+	opts.Sinks = nil
+	opts.NameSpace = c.AWS.Namespace
+	opts.AutoscalingGroupName = group.Name
+	opts.PerHostMetrics = c.Aggregation.PerHostMetrics
+	opts.MinCoverage = c.Aggregation.MinCoverage
+	opts.IncompleteRoundPolicy = incompleteRound
+	opts.StaleGrace = c.Aggregation.StaleGrace
+	opts.StalePolicy = stalePolicy
+	opts.HostValues = hostValues
+	opts.HighResolution = c.Aggregation.HighResolution
+	opts.SelfMetrics = c.Aggregation.SelfMetrics
+	for _, name := range c.Aggregation.HostStatistics {
+		statistic, _ := cw.StatisticFromString(name)
+		opts.HostStatistics = append(opts.HostStatistics, statistic)
+	}
+	for _, s := range c.Sinks {
+		kind, _ := cw.SinkFromString(s.Type)
+		opts.Sinks = append(opts.Sinks, kind)
+		switch kind {
+		case cw.SINK_API:
+			opts.RetryQueuePath = s.RetryQueue
+			if opts.RetryQueuePath != "" && len(c.Aggregation.Groups) > 1 {
+				opts.RetryQueuePath = fmt.Sprintf("%s.%s", s.RetryQueue, group.Name)
+			}
+			opts.RetryQueueSize = s.RetryQueueSize
+			opts.RetryMaxAge = s.RetryMaxAge
+			opts.RetryBackoff.Max = s.RetryBackoffMax
+		case cw.SINK_EMF:
+			opts.EMFOutput = s.Output
+		}
+	}
+	return opts
+}
+
+// GroupOf returns the name of the aggregation group the hosts of an etcd
+// directory belong to
+func (c *Config) GroupOf(dir string) (string, bool) {
+	var fallback *GroupConfig
+	for i, group := range c.Aggregation.Groups {
+		if len(group.EtcdDirs) == 0 {
+			fallback = &c.Aggregation.Groups[i]
+		}
+		for _, d := range group.EtcdDirs {
+			if d == dir {
+				return group.Name, true
+			}
+		}
+	}
+	if fallback == nil {
+		return "", false
+	}
+	return fallback.Name, true
+}
+
+// WebhookReasons returns the reasons of the events posted to the webhook
+func (c *Config) WebhookReasons() []uwsgi.EventReason {
+	reasons := make([]uwsgi.EventReason, 0, len(c.Events.Webhook.Reasons))
+	for _, name := range c.Events.Webhook.Reasons {
+		reason, _ := uwsgi.EventReasonFromName(name)
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+// HasSink tells whether a sink of the given type is configured
+func (c *Config) HasSink(kind int) bool {
+	for _, s := range c.Sinks {
+		k, err := cw.SinkFromString(s.Type)
+		if err == nil && k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validConfig returns a configuration passing the validation, as the
+// command line flags would give it
+func validConfig() *Config {
+	c := &Config{ShutdownTimeout: 10 * time.Second}
+	c.Discovery.Etcd.Hosts = []string{"http://127.0.0.1:2379"}
+	c.Discovery.Etcd.Dirs = []string{"/web", "/api"}
+	c.Discovery.Etcd.Period = 10 * time.Second
+	c.Discovery.Etcd.KeyQuarantine = time.Minute
+	c.Discovery.StatsPort = 1717
+	c.Polling.Period = time.Minute
+	c.Polling.MaxConcurrentPolls = 10
+	c.Polling.DialTimeout = time.Second
+	c.Polling.ReadTimeout = time.Second
+	c.Polling.MaxPayloadSize = 1 << 20
+	c.Polling.FailureThreshold = 3
+	c.Polling.Backoff = BackoffConfig{Initial: time.Second, Max: time.Minute, Jitter: 0.1}
+	c.Polling.ParseErrorPolicy = "skip"
+	c.AWS.Namespace = "uwsgi"
+	c.Sinks = []SinkConfig{{Type: "emf"}}
+	c.Aggregation.Groups = []GroupConfig{{Name: "all"}}
+	c.Aggregation.IncompleteRound = "flag"
+	c.Aggregation.StalePolicy = "exclude"
+	c.Aggregation.HostValues = "none"
+	c.Admin.HealthMissedIntervals = 3
+	c.Logging.Format = "logfmt"
+	c.Logging.Level = "info"
+	return c
+}
+
+func TestValidConfig(t *testing.T) {
+	errs := validConfig().validate()
+	if len(errs) != 0 {
+		t.Fatalf("expected no error, got %s", errs)
+	}
+}
+
+func TestLoadReportsLines(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		errs []string
+	}{
+		{
+			name: "setting",
+			file: "polling:\n  jitter: 1s\n  period: 10ms\n",
+			errs: []string{"config.yml:3: polling.period: must be at least one second"},
+		},
+		{
+			name: "unknown directory",
+			file: "aggregation:\n  groups:\n    - name: web\n      etcd_dirs:\n        - /web\n        - /db\n    - name: rest\n",
+			errs: []string{"config.yml:6: aggregation.groups.0.etcd_dirs.1: /db is not one of discovery.etcd.dirs"},
+		},
+		{
+			name: "directory in two groups",
+			file: "aggregation:\n  groups:\n    - name: web\n      etcd_dirs: [/web]\n    - name: api\n      etcd_dirs: [/api, /web]\n",
+			errs: []string{"config.yml:6: aggregation.groups.1.etcd_dirs.1: /web already belongs to group web"},
+		},
+		{
+			name: "two fallback groups",
+			file: "aggregation:\n  groups:\n    - name: web\n    - name: api\n",
+			errs: []string{"config.yml:4: aggregation.groups.1.etcd_dirs: only one group can have no etcd directory"},
+		},
+		{
+			name: "directory in no group",
+			file: "discovery:\n  etcd:\n    dirs:\n      - /web\n      - /api\naggregation:\n  groups:\n    - name: web\n      etcd_dirs: [/web]\n",
+			errs: []string{"config.yml:5: discovery.etcd.dirs.1: /api does not belong to any aggregation group"},
+		},
+		{
+			name: "setting not in the file",
+			file: "aggregation:\n  groups: []\n",
+			errs: []string{"config.yml:2: aggregation.groups: at least one group is needed"},
+		},
+		{
+			name: "several errors",
+			file: "shutdown_timeout: 0s\nlogging:\n  level: loud\n",
+			errs: []string{
+				"config.yml:1: shutdown_timeout: must be positive",
+				"config.yml:3: logging.level: unknown log level loud, must be one of debug,info,warn,error",
+			},
+		},
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		path := filepath.Join(dir, "config.yml")
+		err := ioutil.WriteFile(path, []byte(test.file), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Load(path, validConfig())
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Fatalf("%s: expected validation errors, got %v", test.name, err)
+		}
+		got := make([]string, 0, len(errs))
+		for _, e := range errs {
+			got = append(got, strings.Replace(e.Error(), path, "config.yml", 1))
+		}
+		if !reflect.DeepEqual(got, test.errs) {
+			t.Fatalf("%s: expected %q, got %q", test.name, test.errs, got)
+		}
+	}
+}
+
+func TestLineOf(t *testing.T) {
+	root := &yaml.Node{}
+	err := yaml.Unmarshal([]byte("polling:\n  period: 1m\naggregation:\n  groups:\n    - name: web\n      etcd_dirs: [/web]\n"), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		line int
+	}{
+		{"", 0},
+		{"polling.period", 2},
+		// the closest enclosing setting found in the file
+		{"polling.jitter", 1},
+		{"aws.region", 0},
+		{"aggregation.groups.0.etcd_dirs.0", 6},
+		{"aggregation.groups.0.name", 5},
+		// an index past the end of the sequence
+		{"aggregation.groups.1.name", 4},
+		{"aggregation.groups.x", 4},
+	}
+	for _, test := range tests {
+		line := lineOf(root, test.path)
+		if line != test.line {
+			t.Fatalf("%s: expected line %d, got %d", test.path, test.line, line)
+		}
+	}
+	if line := lineOf(&yaml.Node{}, "polling.period"); line != 0 {
+		t.Fatalf("expected line 0 without a file, got %d", line)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   string
+		value string
+		check func(c *Config) interface{}
+		want  interface{}
+		err   string
+	}{
+		{
+			name:  "list",
+			env:   "UWSGI_POLLER_DISCOVERY_ETCD_DIRS",
+			value: "/web, ,/api,",
+			check: func(c *Config) interface{} { return c.Discovery.Etcd.Dirs },
+			want:  []string{"/web", "/api"},
+		},
+		{
+			name:  "empty list",
+			env:   "UWSGI_POLLER_AGGREGATION_HOST_STATISTICS",
+			value: "",
+			check: func(c *Config) interface{} { return c.Aggregation.HostStatistics },
+			want:  []string{},
+		},
+		{
+			name:  "map",
+			env:   "UWSGI_POLLER_LOGGING_LEVELS",
+			value: "uwsgi=debug, etcd = warn",
+			check: func(c *Config) interface{} { return c.Logging.Levels },
+			want:  map[string]string{"uwsgi": "debug", "etcd": "warn"},
+		},
+		{
+			name:  "map value with =",
+			env:   "UWSGI_POLLER_LOGGING_LEVELS",
+			value: "uwsgi=a=b",
+			check: func(c *Config) interface{} { return c.Logging.Levels },
+			want:  map[string]string{"uwsgi": "a=b"},
+		},
+		{
+			name:  "map with an empty key",
+			env:   "UWSGI_POLLER_LOGGING_LEVELS",
+			value: "uwsgi=debug, =warn",
+			err:   "logging.levels: invalid value in UWSGI_POLLER_LOGGING_LEVELS: =warn is not in the key=value format",
+		},
+		{
+			name:  "map item without a value",
+			env:   "UWSGI_POLLER_LOGGING_LEVELS",
+			value: "uwsgi",
+			err:   "logging.levels: invalid value in UWSGI_POLLER_LOGGING_LEVELS: uwsgi is not in the key=value format",
+		},
+		{
+			name:  "list of structs",
+			env:   "UWSGI_POLLER_SINKS",
+			value: "api",
+			err:   "sinks: invalid value in UWSGI_POLLER_SINKS: can only be set in the configuration file",
+		},
+		{
+			name:  "duration",
+			env:   "UWSGI_POLLER_POLLING_PERIOD",
+			value: "30s",
+			check: func(c *Config) interface{} { return c.Polling.Period },
+			want:  30 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		os.Setenv(test.env, test.value)
+		c := validConfig()
+		errs := applyEnv(c)
+		os.Unsetenv(test.env)
+		if test.err != "" {
+			if len(errs) != 1 || errs[0].Error() != "configuration: "+test.err {
+				t.Fatalf("%s: expected error %q, got %v", test.name, test.err, errs)
+			}
+			continue
+		}
+		if len(errs) != 0 {
+			t.Fatalf("%s: expected no error, got %s", test.name, errs)
+		}
+		if got := test.check(c); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EnvPrefix starts the name of the environment variables overriding the
+	// settings, e.g. UWSGI_POLLER_AWS_SECRET_KEY overrides aws.secret_key
+	EnvPrefix = "UWSGI_POLLER_"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// EnvName returns the environment variable overriding the setting with the
+// given dotted path
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// applyEnv overrides the settings with the environment variables. lists
+// are given comma separated and maps as comma separated key=value pairs,
+// the lists of sinks and groups can only be set in the configuration file
+func applyEnv(c *Config) ValidationErrors {
+	v := &validator{}
+	applyEnvStruct(v, reflect.ValueOf(c).Elem(), "")
+	return v.errs
+}
+
+func applyEnvStruct(v *validator, s reflect.Value, prefix string) {
+	for i := 0; i < s.NumField(); i++ {
+		tag := strings.Split(s.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" {
+			continue
+		}
+		path := prefix + tag
+		field := s.Field(i)
+		if field.Kind() == reflect.Struct {
+			applyEnvStruct(v, field, path+".")
+			continue
+		}
+		value, ok := os.LookupEnv(EnvName(path))
+		if !ok {
+			continue
+		}
+		err := setField(field, value)
+		if err != nil {
+			v.errorf(path, "invalid value in %s: %s", EnvName(path), err)
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			// sinks and groups
+			return fmt.Errorf("can only be set in the configuration file")
+		}
+		field.Set(reflect.ValueOf(splitList(value)))
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the configuration file")
+		}
+		values := make(map[string]string)
+		for _, item := range splitList(value) {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return fmt.Errorf("%s is not in the key=value format", item)
+			}
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("can only be set in the configuration file")
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping the empty items
+func splitList(value string) []string {
+	values := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
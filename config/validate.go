@@ -0,0 +1,324 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem with a single setting. Path is the dotted
+// path of the setting, e.g. polling.period, Line the line of the
+// configuration file it was read from or 0 if it was not read from the file
+type ValidationError struct {
+	File string
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	location := e.File
+	if location == "" {
+		location = "configuration"
+	}
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, e.Line)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", location, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, e.Path, e.Msg)
+}
+
+// ValidationErrors are all the problems found in a configuration
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{
+		Path: path,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.errorf(path, "%s", err)
+	}
+}
+
+func (c *Config) validate() ValidationErrors {
+	v := &validator{}
+
+	if c.ShutdownTimeout <= 0 {
+		v.errorf("shutdown_timeout", "must be positive")
+	}
+
+	if len(c.Discovery.Etcd.Hosts) == 0 {
+		v.errorf("discovery.etcd.hosts", "at least one etcd host is needed")
+	}
+	if len(c.Discovery.Etcd.Dirs) == 0 {
+		v.errorf("discovery.etcd.dirs", "at least one etcd directory is needed")
+	}
+	if c.Discovery.Etcd.Period <= 0 {
+		v.errorf("discovery.etcd.period", "must be positive")
+	}
+	if c.Discovery.Etcd.KeyQuarantine <= 0 {
+		v.errorf("discovery.etcd.key_quarantine", "must be positive")
+	}
+	if c.Discovery.StatsPort <= 0 || c.Discovery.StatsPort > 65535 {
+		v.errorf("discovery.stats_port", "%d is not a valid port", c.Discovery.StatsPort)
+	}
+
+	p := c.Polling
+	if p.Period < time.Second {
+		v.errorf("polling.period", "must be at least one second")
+	}
+	if p.MaxConcurrentPolls <= 0 {
+		v.errorf("polling.max_concurrent_polls", "must be positive")
+	}
+	if p.Jitter < 0 {
+		v.errorf("polling.jitter", "cannot be negative")
+	}
+	if p.RoundGrace < 0 {
+		v.errorf("polling.round_grace", "cannot be negative")
+	}
+	if p.DialTimeout <= 0 {
+		v.errorf("polling.dial_timeout", "must be positive")
+	}
+	if p.ReadTimeout <= 0 {
+		v.errorf("polling.read_timeout", "must be positive")
+	}
+	if p.MaxPayloadSize <= 0 {
+		v.errorf("polling.max_payload_size", "must be positive")
+	}
+	if p.FailureThreshold <= 0 {
+		v.errorf("polling.failure_threshold", "must be positive")
+	}
+	if p.Backoff.Initial <= 0 {
+		v.errorf("polling.backoff.initial", "must be positive")
+	}
+	if p.Backoff.Max < p.Backoff.Initial {
+		v.errorf("polling.backoff.max", "cannot be shorter than polling.backoff.initial")
+	}
+	if p.Backoff.Jitter < 0 || p.Backoff.Jitter > 1 {
+		v.errorf("polling.backoff.jitter", "must be between 0 and 1")
+	}
+	_, err := uwsgi.ParseErrorPolicyFromString(p.ParseErrorPolicy)
+	v.check("polling.parse_error_policy", err)
+	_, err = uwsgi.NewWorkerClassifier(p.AvailableWorkerStates, p.InactiveWorkerStates)
+	v.check("polling.available_worker_states", err)
+
+	w := c.Events.Webhook
+	if w.URL != "" {
+		u, err := url.Parse(w.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			v.errorf("events.webhook.url", "%s is not a valid url", w.URL)
+		}
+		if w.Timeout <= 0 {
+			v.errorf("events.webhook.timeout", "must be positive")
+		}
+	}
+	for i, name := range w.Reasons {
+		_, err := uwsgi.EventReasonFromName(name)
+		v.check(fmt.Sprintf("events.webhook.reasons.%d", i), err)
+	}
+
+	if len(c.Sinks) == 0 {
+		v.errorf("sinks", "at least one sink is needed")
+	}
+	seen := make(map[int]bool)
+	for i, s := range c.Sinks {
+		path := fmt.Sprintf("sinks.%d", i)
+		kind, err := cw.SinkFromString(s.Type)
+		if err != nil {
+			v.check(path+".type", err)
+			continue
+		}
+		if seen[kind] {
+			v.errorf(path+".type", "sink %s is configured more than once", s.Type)
+		}
+		seen[kind] = true
+		if kind == cw.SINK_API {
+			if s.RetryQueueSize < 0 {
+				v.errorf(path+".retry_queue_size", "cannot be negative")
+			}
+			if s.RetryBackoffMax <= 0 {
+				v.errorf(path+".retry_backoff_max", "must be positive")
+			}
+		}
+	}
+	if c.HasSink(cw.SINK_API) && c.AWS.Region == "" {
+		v.errorf("aws.region", "is needed by the api sink")
+	}
+	if c.AWS.Namespace == "" {
+		v.errorf("aws.namespace", "is needed")
+	}
+
+	a := c.Aggregation
+	if a.MinCoverage < 0 || a.MinCoverage > 1 {
+		v.errorf("aggregation.min_coverage", "must be between 0 and 1")
+	}
+	_, err = cw.IncompleteRoundPolicyFromString(a.IncompleteRound)
+	v.check("aggregation.incomplete_round", err)
+	if a.StaleGrace < 0 {
+		v.errorf("aggregation.stale_grace", "cannot be negative")
+	}
+	_, err = cw.StalePolicyFromString(a.StalePolicy)
+	v.check("aggregation.stale_policy", err)
+	for i, name := range a.HostStatistics {
+		_, err := cw.StatisticFromString(name)
+		v.check(fmt.Sprintf("aggregation.host_statistics.%d", i), err)
+	}
+	_, err = cw.HostValuesModeFromString(a.HostValues)
+	v.check("aggregation.host_values", err)
+	c.validateGroups(v)
+
+	if c.Admin.Listen != "" {
+		host, _, err := net.SplitHostPort(c.Admin.Listen)
+		v.check("admin.listen", err)
+		if err == nil && c.Admin.Token == "" && !isLoopback(host) {
+			v.errorf("admin.listen", "%s is not a loopback address, admin.token must be set", c.Admin.Listen)
+		}
+	}
+	if c.Admin.HealthMissedIntervals < 1 {
+		v.errorf("admin.health_missed_intervals", "must be at least 1")
+	}
+
+	l := c.Logging
+	_, err = logging.FormatFromString(l.Format)
+	v.check("logging.format", err)
+	_, err = logging.LevelFromString(l.Level)
+	v.check("logging.level", err)
+	components := logging.Components()
+	for component, name := range l.Levels {
+		path := "logging.levels." + component
+		i := sort.SearchStrings(components, component)
+		if i == len(components) || components[i] != component {
+			v.errorf(path, "unknown component, must be one of %s", strings.Join(components, ","))
+			continue
+		}
+		_, err := logging.LevelFromString(name)
+		v.check(path, err)
+	}
+	if l.RateLimit < 0 {
+		v.errorf("logging.rate_limit", "cannot be negative")
+	}
+
+	return v.errs
+}
+
+// validateGroups checks that every etcd directory belongs to exactly one
+// aggregation group
+func (c *Config) validateGroups(v *validator) {
+	if len(c.Aggregation.Groups) == 0 {
+		v.errorf("aggregation.groups", "at least one group is needed")
+	}
+	dirs := make(map[string]bool)
+	for _, dir := range c.Discovery.Etcd.Dirs {
+		dirs[dir] = true
+	}
+	names := make(map[string]bool)
+	owners := make(map[string]string)
+	fallbacks := 0
+	for i, group := range c.Aggregation.Groups {
+		path := fmt.Sprintf("aggregation.groups.%d", i)
+		if group.Name == "" {
+			v.errorf(path+".name", "is needed")
+		}
+		if names[group.Name] {
+			v.errorf(path+".name", "group %s is configured more than once", group.Name)
+		}
+		names[group.Name] = true
+		if len(group.EtcdDirs) == 0 {
+			fallbacks += 1
+			if fallbacks > 1 {
+				v.errorf(path+".etcd_dirs", "only one group can have no etcd directory")
+			}
+		}
+		for j, dir := range group.EtcdDirs {
+			dirPath := fmt.Sprintf("%s.etcd_dirs.%d", path, j)
+			if !dirs[dir] {
+				v.errorf(dirPath, "%s is not one of discovery.etcd.dirs", dir)
+			}
+			if owner, ok := owners[dir]; ok {
+				v.errorf(dirPath, "%s already belongs to group %s", dir, owner)
+			}
+			owners[dir] = group.Name
+		}
+	}
+	if fallbacks == 0 && len(c.Aggregation.Groups) > 0 {
+		for i, dir := range c.Discovery.Etcd.Dirs {
+			if _, ok := owners[dir]; !ok {
+				v.errorf(fmt.Sprintf("discovery.etcd.dirs.%d", i), "%s does not belong to any aggregation group", dir)
+			}
+		}
+	}
+}
+
+// lineOf returns the line of the configuration file the setting with the
+// given dotted path was read from, or the closest enclosing one it can find
+func lineOf(root *yaml.Node, path string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	if path == "" {
+		return line
+	}
+	for _, key := range strings.Split(path, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					line = node.Content[i].Line
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(key)
+			if err == nil && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// isLoopback tells whether a listen host only accepts local connections, an
+// empty host listens on every interface
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
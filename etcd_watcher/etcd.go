@@ -2,14 +2,19 @@ package etcd_watcher
 
 import (
 	"fmt"
-	"log"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/client"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
 	"golang.org/x/net/context"
 	"gopkg.in/fatih/set.v0"
 )
 
+var logger = logging.New("etcd")
+
 const (
 	HOST_ADDED = iota
 	HOST_REMOVED
@@ -19,9 +24,34 @@ const (
 	ETCD_KEY_ERROR
 )
 
+const (
+	// DefaultKeyQuarantine is how long a key that cannot be read or parsed
+	// is ignored before being read again
+	DefaultKeyQuarantine = 5 * time.Minute
+)
+
+// KeyError is the data of the events about a single key that cannot be read
+// or whose value is not in the HOST:PORT format
+type KeyError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (k *KeyError) Error() string {
+	if k.Value == "" {
+		return fmt.Sprintf("key %s: %s", k.Key, k.Err)
+	}
+	return fmt.Sprintf("key %s value %q: %s", k.Key, k.Value, k.Err)
+}
+
 type EtcdEvent struct {
 	Reason int
+	Dir    string
 	Data   interface{}
+	// Watcher is the watcher that sent the event, the events still queued
+	// when it is replaced can be told apart from the ones of its replacement
+	Watcher *EtcdWatcher
 }
 
 func (e *EtcdEvent) String() string {
@@ -34,13 +64,15 @@ func (e *EtcdEvent) String() string {
 		ETCD_KEY_ERROR:   "unable to read key",
 	}
 	msg, _ := evts[e.Reason]
-	return fmt.Sprintf("%s. data: %+v", msg, e.Data)
+	return fmt.Sprintf("%s. dir: %s data: %+v", msg, e.Dir, e.Data)
 }
 
-func makeEtcdEvent(reason int, data interface{}) *EtcdEvent {
+func (e *EtcdWatcher) event(reason int, data interface{}) *EtcdEvent {
 	return &EtcdEvent{
-		Reason: reason,
-		Data:   data,
+		Reason:  reason,
+		Dir:     e.Dir,
+		Data:    data,
+		Watcher: e,
 	}
 }
 
@@ -51,17 +83,41 @@ type EtcdWatcher struct {
 	ticker     *time.Ticker
 	client     client.KeysAPI
 	hosts      *set.Set
+	log        *logging.Logger
 	EventsChan chan<- *EtcdEvent
+	// KeepHostsOnError keeps the last known hosts while the directory cannot
+	// be read, instead of reporting them all as removed
+	KeepHostsOnError bool
+	// KeyQuarantine is how long a bad key is ignored, its last good value,
+	// if any, is kept meanwhile
+	KeyQuarantine time.Duration
+	// synced is set once the initial host set has been read
+	synced  bool
+	quit    chan int
+	refresh chan int
+	// lastSync is the last time the directory was read successfully
+	syncLock sync.Mutex
+	lastSync time.Time
+	// values holds the last good value of every key, quarantine the time
+	// until which each bad key is ignored
+	values     map[string]string
+	quarantine map[string]time.Time
 }
 
 func NewEtcdWatcher(endpoints []string, dir string, pollTime int, eventsChan chan<- *EtcdEvent) (e *EtcdWatcher, err error) {
 	e = &EtcdWatcher{
-		Endpoints:  endpoints,
-		Dir:        dir,
-		PollTime:   time.Duration(pollTime),
-		ticker:     time.NewTicker(time.Duration(pollTime) * time.Second),
-		hosts:      set.New(),
-		EventsChan: eventsChan,
+		Endpoints:     endpoints,
+		Dir:           dir,
+		PollTime:      time.Duration(pollTime),
+		ticker:        time.NewTicker(time.Duration(pollTime) * time.Second),
+		hosts:         set.New(),
+		log:           logger.With("dir", dir),
+		EventsChan:    eventsChan,
+		KeyQuarantine: DefaultKeyQuarantine,
+		quit:          make(chan int),
+		refresh:       make(chan int, 1),
+		values:        make(map[string]string),
+		quarantine:    make(map[string]time.Time),
 	}
 
 	cfg := client.Config{
@@ -71,28 +127,28 @@ func NewEtcdWatcher(endpoints []string, dir string, pollTime int, eventsChan cha
 	}
 	c, err := client.New(cfg)
 	if err != nil {
-		log.Fatalf("error creating etcd watcher: %s", err)
+		return nil, fmt.Errorf("error creating etcd client for %s: %s", dir, err)
 	}
 	e.client = client.NewKeysAPI(c)
-	log.Printf("created etcd watcher on directory %s for hosts %s polling time %d seconds", dir, endpoints, pollTime)
+	e.log.Infof("created etcd watcher for hosts %s polling time %d seconds", endpoints, pollTime)
 	return e, nil
 }
 
-func (e *EtcdWatcher) getSingleNode(n *client.Node) (s string, err error) {
+func (e *EtcdWatcher) getSingleNode(ctx context.Context, n *client.Node) (s string, err error) {
 	// when we expire this value we return error reading from etcd
 	retry_counter := 10
 	for {
-		resp, err := e.client.Get(context.Background(), n.Key, nil)
+		resp, err := e.client.Get(ctx, n.Key, nil)
 		// check for error and retry, decreasing the counter, if there is one
 		if err != nil {
 			if err == context.Canceled {
-				log.Printf("context canceled: %s", err)
+				e.log.Debugf("context canceled: %s", err)
 			} else if err == context.DeadlineExceeded {
-				log.Printf("context deadline exceeded: %s", err)
+				e.log.Warnf("context deadline exceeded: %s", err)
 			} else if cerr, ok := err.(*client.ClusterError); ok {
-				log.Printf("cluster errors: %s", cerr.Errors)
+				e.log.Warnf("cluster errors: %s", cerr.Errors)
 			} else {
-				log.Printf("error reading key %s: %s", n.Key, err)
+				e.log.Warnf("error reading key %s: %s", n.Key, err)
 			}
 			retry_counter -= 1
 		} else {
@@ -100,7 +156,7 @@ func (e *EtcdWatcher) getSingleNode(n *client.Node) (s string, err error) {
 			return resp.Node.Value, nil
 		}
 		time.Sleep(500 * time.Millisecond)
-		if retry_counter == 0 {
+		if retry_counter == 0 || ctx.Err() != nil {
 			return "", err
 		}
 	}
@@ -109,61 +165,202 @@ func (e *EtcdWatcher) getSingleNode(n *client.Node) (s string, err error) {
 func (e *EtcdWatcher) handleHosts(newSet *set.Set) {
 	for _, host := range newSet.List() {
 		if !e.hosts.Has(host) {
-			log.Printf("ADD evt %s", host)
-			e.EventsChan <- makeEtcdEvent(HOST_ADDED, host)
+			e.log.Infof("host added %s", host)
+			e.EventsChan <- e.event(HOST_ADDED, host)
 			e.hosts.Add(host)
 		}
 	}
 	for _, host := range e.hosts.List() {
 		if !newSet.Has(host) {
-			log.Printf("REMOVE evt %s", host)
-			e.EventsChan <- makeEtcdEvent(HOST_REMOVED, host)
+			e.log.Infof("host removed %s", host)
+			e.EventsChan <- e.event(HOST_REMOVED, host)
 			e.hosts.Remove(host)
 		}
 	}
 }
 
-func (e *EtcdWatcher) Run() {
-	firstRun := true
+// Seed makes the watcher start from an already known host set, e.g. the one
+// of the watcher it replaces, so that only the differences with it are
+// reported. it must be called before Run
+func (e *EtcdWatcher) Seed(hosts []string) {
+	for _, h := range hosts {
+		e.hosts.Add(h)
+	}
+	e.synced = true
+	e.setLastSync(time.Now())
+}
+
+func (e *EtcdWatcher) setLastSync(t time.Time) {
+	e.syncLock.Lock()
+	e.lastSync = t
+	e.syncLock.Unlock()
+}
+
+// LastSync returns the last time the directory was read successfully, or
+// the time the watcher was seeded. it is zero until the first read
+func (e *EtcdWatcher) LastSync() time.Time {
+	e.syncLock.Lock()
+	defer e.syncLock.Unlock()
+	return e.lastSync
+}
+
+// Hosts returns the hosts currently known to the watcher
+func (e *EtcdWatcher) Hosts() []string {
+	return set.StringSlice(e.hosts)
+}
+
+// Stop stops watching the directory, no event is sent after it returns
+// unless one was already being sent
+func (e *EtcdWatcher) Stop() {
+	e.ticker.Stop()
+	close(e.quit)
+}
+
+// Refresh makes the watcher read the directory right away instead of
+// waiting for its next period
+func (e *EtcdWatcher) Refresh() {
+	select {
+	case e.refresh <- 1:
+	default:
+	}
+}
+
+// Run watches the directory until Stop is called or the context is done.
+// errors reading etcd are reported as events and the directory is read
+// again at the next period
+func (e *EtcdWatcher) Run(ctx context.Context) {
 	for {
 		select {
+		case <-e.quit:
+			e.log.Infof("stopped etcd watcher")
+			return
+		case <-ctx.Done():
+			e.ticker.Stop()
+			e.log.Infof("stopped etcd watcher")
+			return
 		case <-e.ticker.C:
-			resp, err := e.client.Get(context.Background(), e.Dir, nil)
-			if err != nil {
-				log.Printf("error reading key %s: %s", e.Dir, err)
-				e.EventsChan <- makeEtcdEvent(ETCD_DIR_ERROR, err)
-				return
+		case <-e.refresh:
+			e.log.Infof("refreshing etcd directory")
+		}
+		newSet, err := e.readHosts(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
 			}
-			if resp.Node.Dir {
-				newSet := set.New()
-				for _, k := range resp.Node.Nodes {
-					if k.Dir {
-						// we do not need to recurse into any dir here
-						continue
-					}
-					str, err := e.getSingleNode(k)
-					if err != nil {
-						log.Printf("error getting key %s: %s", k.Key, err)
-						e.EventsChan <- makeEtcdEvent(ETCD_KEY_ERROR, err)
-						continue
-					}
-					newSet.Add(str)
-				}
-				if firstRun {
-					for _, h := range newSet.List() {
-						log.Printf("found initial host: %s", h)
-						e.hosts.Add(h)
-						e.EventsChan <- makeEtcdEvent(HOST_ADDED, h)
-					}
-					firstRun = false
-				} else {
-					e.handleHosts(newSet)
+			e.handleError(err)
+			continue
+		}
+		if !e.synced {
+			for _, h := range newSet.List() {
+				e.log.Infof("found initial host %s", h)
+				e.hosts.Add(h)
+				e.EventsChan <- e.event(HOST_ADDED, h)
+			}
+			e.synced = true
+		} else {
+			e.handleHosts(newSet)
+		}
+		e.setLastSync(time.Now())
+	}
+}
+
+// readHosts reads the hosts listed in the directory. the keys that cannot be
+// read or parsed are quarantined and reported, the error returned is about
+// the directory as a whole
+func (e *EtcdWatcher) readHosts(ctx context.Context) (*set.Set, error) {
+	resp, err := e.client.Get(ctx, e.Dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Node.Dir {
+		return nil, fmt.Errorf("the key provided is not a directory: %s", e.Dir)
+	}
+	now := time.Now()
+	newSet := set.New()
+	seen := make(map[string]bool)
+	for _, k := range resp.Node.Nodes {
+		if k.Dir {
+			// we do not need to recurse into any dir here
+			continue
+		}
+		seen[k.Key] = true
+		if until, ok := e.quarantine[k.Key]; ok {
+			if now.Before(until) {
+				if v, ok := e.values[k.Key]; ok {
+					newSet.Add(v)
 				}
-			} else {
-				log.Printf("the key provided is not a directory: %s", e.Dir)
-				e.EventsChan <- makeEtcdEvent(ETCD_DIR_ERROR, e.Dir)
-				return
+				continue
 			}
+			e.log.Infof("key %s out of quarantine", k.Key)
+			delete(e.quarantine, k.Key)
+		}
+		str, err := e.getSingleNode(ctx, k)
+		if err != nil {
+			e.quarantineKey(k.Key, ETCD_KEY_ERROR, &KeyError{Key: k.Key, Err: err})
+		} else if perr := checkHost(str); perr != nil {
+			e.quarantineKey(k.Key, HOST_PARSE_ERROR, &KeyError{Key: k.Key, Value: str, Err: perr})
+		} else {
+			e.values[k.Key] = str
+		}
+		if v, ok := e.values[k.Key]; ok {
+			newSet.Add(v)
+		}
+	}
+	// forget the keys that were deleted
+	for key := range e.values {
+		if !seen[key] {
+			delete(e.values, key)
+			delete(e.quarantine, key)
+		}
+	}
+	return newSet, nil
+}
+
+// quarantineKey ignores a bad key for KeyQuarantine and reports it
+func (e *EtcdWatcher) quarantineKey(key string, reason int, kerr *KeyError) {
+	e.log.Warnf("quarantining %s for %s", kerr, e.KeyQuarantine)
+	e.quarantine[key] = time.Now().Add(e.KeyQuarantine)
+	e.EventsChan <- e.event(reason, kerr)
+}
+
+// handleError reports a failure reading the directory. unless
+// KeepHostsOnError is set the hosts are reported as removed, they are added
+// back once the directory can be read again
+func (e *EtcdWatcher) handleError(err error) {
+	reason := ETCD_DIR_ERROR
+	if isUnreachable(err) {
+		reason = ETCD_UNREACHABLE
+	}
+	e.log.Errorf("error reading directory: %s", err)
+	e.EventsChan <- e.event(reason, err)
+	if e.KeepHostsOnError {
+		if e.hosts.Size() > 0 {
+			e.log.Warnf("keeping the %d last known hosts", e.hosts.Size())
 		}
+		return
+	}
+	e.handleHosts(set.New())
+}
+
+func isUnreachable(err error) bool {
+	if _, ok := err.(*client.ClusterError); ok {
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// checkHost checks that a value is in the HOST:PORT format
+func checkHost(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port %s", port)
 	}
+	return nil
 }
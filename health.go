@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// healthCheck is the outcome of one of the checks behind /healthz and
+// /readyz
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string         `json:"status"`
+	Checks []*healthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []*healthCheck, failed string) (*healthReport, bool) {
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Name < checks[j].Name
+	})
+	report := &healthReport{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			report.Status = failed
+			return report, false
+		}
+	}
+	return report, true
+}
+
+func writeHealth(w http.ResponseWriter, report *healthReport, ok bool) {
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// readiness checks that discovery read every etcd directory at least once,
+// found hosts to poll and that a collection round was closed with at least
+// a host polled in it
+func readiness() (*healthReport, bool) {
+	checks := make([]*healthCheck, 0)
+	stateLock.RLock()
+	for dir, watcher := range etcdWatchers {
+		c := &healthCheck{Name: "discovery " + dir, OK: !watcher.LastSync().IsZero()}
+		if !c.OK {
+			c.Detail = "not synced yet"
+		}
+		checks = append(checks, c)
+	}
+	stateLock.RUnlock()
+	targets := len(uwsgiScheduler.Pollers())
+	c := &healthCheck{Name: "targets", OK: targets > 0, Detail: fmt.Sprintf("%d hosts", targets)}
+	if !c.OK {
+		c.Detail = "no host discovered"
+	}
+	checks = append(checks, c)
+	closed, polled := uwsgiScheduler.RoundsClosed(), uwsgiScheduler.RoundsPolled()
+	c = &healthCheck{Name: "rounds", OK: polled > 0, Detail: fmt.Sprintf("%d closed, %d with hosts polled", closed, polled)}
+	checks = append(checks, c)
+	return newHealthReport(checks, "not ready")
+}
+
+// health checks that every etcd directory was read and every sink pushed
+// within the last HealthMissedIntervals periods
+func health() (*healthReport, bool) {
+	checks := make([]*healthCheck, 0)
+	now := time.Now()
+	stateLock.RLock()
+	missed := time.Duration(cfg.Admin.HealthMissedIntervals)
+	etcdDeadline := now.Add(-missed * cfg.Discovery.Etcd.Period)
+	pushDeadline := now.Add(-missed*cfg.Polling.Period - cfg.Polling.RoundGrace)
+	for dir, watcher := range etcdWatchers {
+		last := watcher.LastSync()
+		if last.IsZero() {
+			last = startTime
+		}
+		checks = append(checks, checkSince("discovery "+dir, "read", last, etcdDeadline, now))
+	}
+	for group, pusher := range pushers {
+		for sink, last := range pusher.LastPushes() {
+			checks = append(checks, checkSince(fmt.Sprintf("sink %s %s", group, sink), "pushed", last, pushDeadline, now))
+		}
+	}
+	stateLock.RUnlock()
+	return newHealthReport(checks, "unhealthy")
+}
+
+func checkSince(name, what string, last, deadline, now time.Time) *healthCheck {
+	return &healthCheck{
+		Name:   name,
+		OK:     !last.Before(deadline),
+		Detail: fmt.Sprintf("last %s %s ago", what, now.Sub(last).Truncate(time.Second)),
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report, ok := health()
+	writeHealth(w, report, ok)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report, ok := readiness()
+	writeHealth(w, report, ok)
+}
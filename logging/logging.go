@@ -0,0 +1,352 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEBUG = iota
+	INFO
+	WARN
+	ERROR
+)
+
+const (
+	FORMAT_LOGFMT = iota
+	FORMAT_JSON
+)
+
+const (
+	// DefaultRateLimit is how long the repeated warnings and errors about
+	// the same host are suppressed after being logged once
+	DefaultRateLimit = time.Minute
+	// maxLimited is how many rate limited messages are tracked before the
+	// expired ones are forgotten
+	maxLimited = 10000
+)
+
+var (
+	levels = map[string]int{
+		"debug": DEBUG,
+		"info":  INFO,
+		"warn":  WARN,
+		"error": ERROR,
+	}
+	formats = map[string]int{
+		"logfmt": FORMAT_LOGFMT,
+		"json":   FORMAT_JSON,
+	}
+	// LevelNames lists the accepted names of the levels
+	LevelNames = []string{"debug", "info", "warn", "error"}
+	// FormatNames lists the accepted names of the formats
+	FormatNames = []string{"logfmt", "json"}
+)
+
+func LevelFromString(name string) (int, error) {
+	level, ok := levels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %s, must be one of %s", name, strings.Join(LevelNames, ","))
+	}
+	return level, nil
+}
+
+func FormatFromString(name string) (int, error) {
+	format, ok := formats[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log format %s, must be one of %s", name, strings.Join(FormatNames, ","))
+	}
+	return format, nil
+}
+
+func LevelName(level int) string {
+	if level < 0 || level >= len(LevelNames) {
+		return "unknown"
+	}
+	return LevelNames[level]
+}
+
+// limit tracks a message being rate limited
+type limit struct {
+	until      time.Time
+	suppressed int
+}
+
+// the state shared by every logger, guarded by lock
+var (
+	lock         sync.Mutex
+	output       io.Writer = os.Stderr
+	format                 = FORMAT_LOGFMT
+	defaultLevel           = INFO
+	// componentLevels are the levels of the components that do not use the
+	// default one, components lists every component a logger was created
+	// for
+	componentLevels = make(map[string]int)
+	components      = make(map[string]bool)
+	rateLimit       = DefaultRateLimit
+	limited         = make(map[string]*limit)
+)
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	output = w
+}
+
+func SetFormat(f int) {
+	lock.Lock()
+	defer lock.Unlock()
+	format = f
+}
+
+// SetRateLimit sets how long the repeated warnings and errors about a host
+// are suppressed, 0 disables the rate limiting
+func SetRateLimit(d time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	rateLimit = d
+	limited = make(map[string]*limit)
+}
+
+// SetDefaultLevel sets the level of the components without a level of
+// their own
+func SetDefaultLevel(level int) {
+	lock.Lock()
+	defer lock.Unlock()
+	defaultLevel = level
+}
+
+// SetLevel sets the level of a component
+func SetLevel(component string, level int) {
+	lock.Lock()
+	defer lock.Unlock()
+	componentLevels[component] = level
+}
+
+// ResetLevel makes a component use the default level again
+func ResetLevel(component string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(componentLevels, component)
+}
+
+// ResetLevels makes every component use the default level again
+func ResetLevels() {
+	lock.Lock()
+	defer lock.Unlock()
+	componentLevels = make(map[string]int)
+}
+
+// Levels returns the default level and the level of every component
+func Levels() (int, map[string]int) {
+	lock.Lock()
+	defer lock.Unlock()
+	current := make(map[string]int, len(components))
+	for component := range components {
+		current[component] = levelOf(component)
+	}
+	return defaultLevel, current
+}
+
+// Components returns the names of the components a logger was created for
+func Components() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	names := make([]string, 0, len(components))
+	for component := range components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func levelOf(component string) int {
+	if level, ok := componentLevels[component]; ok {
+		return level
+	}
+	return defaultLevel
+}
+
+// Logger writes the messages of a component, every line carrying its
+// fields. a logger is safe to be used from any number of goroutines
+type Logger struct {
+	component string
+	// fields are key and value pairs
+	fields []string
+}
+
+func New(component string) *Logger {
+	lock.Lock()
+	components[component] = true
+	lock.Unlock()
+	return &Logger{component: component}
+}
+
+// With returns a logger adding a field to every line. the warnings and
+// errors of loggers with a host field are rate limited
+func (l *Logger) With(key, value string) *Logger {
+	fields := make([]string, 0, len(l.fields)+2)
+	fields = append(fields, l.fields...)
+	fields = append(fields, key, value)
+	return &Logger{component: l.component, fields: fields}
+}
+
+func (l *Logger) field(key string) string {
+	for i := 0; i < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			return l.fields[i+1]
+		}
+	}
+	return ""
+}
+
+func (l *Logger) Debugf(msg string, args ...interface{}) {
+	l.log(DEBUG, msg, args...)
+}
+
+func (l *Logger) Infof(msg string, args ...interface{}) {
+	l.log(INFO, msg, args...)
+}
+
+func (l *Logger) Warnf(msg string, args ...interface{}) {
+	l.log(WARN, msg, args...)
+}
+
+func (l *Logger) Errorf(msg string, args ...interface{}) {
+	l.log(ERROR, msg, args...)
+}
+
+// Fatalf logs an error and exits
+func (l *Logger) Fatalf(msg string, args ...interface{}) {
+	l.log(ERROR, msg, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level int, msg string, args ...interface{}) {
+	l.logKeyed(level, msg, msg, args...)
+}
+
+// logKeyed logs a message rate limited by key rather than by its format
+func (l *Logger) logKeyed(level int, key, msg string, args ...interface{}) {
+	now := time.Now()
+	lock.Lock()
+	defer lock.Unlock()
+	if level < levelOf(l.component) {
+		return
+	}
+	suppressed, ok := l.limit(level, key, now)
+	if !ok {
+		return
+	}
+	fields := make([]string, 0, len(l.fields)+10)
+	fields = append(fields,
+		"time", now.Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", LevelName(level),
+		"component", l.component)
+	fields = append(fields, l.fields...)
+	fields = append(fields, "msg", fmt.Sprintf(msg, args...))
+	if suppressed > 0 {
+		fields = append(fields, "suppressed", fmt.Sprintf("%d", suppressed))
+	}
+	var line string
+	if format == FORMAT_JSON {
+		line = encodeJSON(fields)
+	} else {
+		line = encodeLogfmt(fields)
+	}
+	io.WriteString(output, line+"\n")
+}
+
+// limit tells whether a warning or error about a host is logged: the same
+// message about the same host is logged once per rate limit period, along
+// with the number of times it was suppressed since it was last logged.
+// messages are told apart by their format, not by their arguments, and the
+// lines written to a Writer by their whole content
+func (l *Logger) limit(level int, key string, now time.Time) (suppressed int, ok bool) {
+	host := l.field("host")
+	if level < WARN || rateLimit <= 0 || host == "" {
+		return 0, true
+	}
+	key = l.component + "\x00" + host + "\x00" + key
+	lim, found := limited[key]
+	if found && now.Before(lim.until) {
+		lim.suppressed += 1
+		return 0, false
+	}
+	if !found {
+		if len(limited) >= maxLimited {
+			forgetExpired(now)
+		}
+		lim = &limit{}
+		limited[key] = lim
+	}
+	suppressed = lim.suppressed
+	lim.until = now.Add(rateLimit)
+	lim.suppressed = 0
+	return suppressed, true
+}
+
+// forgetExpired forgets the rate limited messages whose period is over,
+// those that were suppressed meanwhile are only forgotten when there are
+// still too many
+func forgetExpired(now time.Time) {
+	for key, lim := range limited {
+		if now.After(lim.until) && lim.suppressed == 0 {
+			delete(limited, key)
+		}
+	}
+	if len(limited) < maxLimited {
+		return
+	}
+	for key, lim := range limited {
+		if now.After(lim.until) {
+			delete(limited, key)
+		}
+	}
+}
+
+func encodeLogfmt(fields []string) string {
+	parts := make([]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		parts = append(parts, fields[i]+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func encodeJSON(fields []string) string {
+	parts := make([]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		key, _ := json.Marshal(fields[i])
+		value, _ := json.Marshal(fields[i+1])
+		parts = append(parts, string(key)+":"+string(value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// writer turns what is written to it into log lines
+type writer struct {
+	logger *Logger
+	level  int
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	w.logger.logKeyed(w.level, line, "%s", line)
+	return len(p), nil
+}
+
+// Writer returns a writer logging every write as a line of the given level,
+// e.g. to redirect the standard library logger
+func (l *Logger) Writer(level int) io.Writer {
+	return &writer{logger: l, level: level}
+}
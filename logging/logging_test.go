@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterRateLimitsByLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	SetRateLimit(time.Minute)
+	defer func() {
+		SetOutput(os.Stderr)
+		SetRateLimit(0)
+	}()
+	w := New("test").With("host", "10.0.0.1:1717").Writer(WARN)
+	w.Write([]byte("connection refused\n"))
+	w.Write([]byte("payload too large\n"))
+	w.Write([]byte("connection refused\n"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected each distinct line to be logged once, got %q", lines)
+	}
+	if !strings.Contains(lines[1], "payload too large") {
+		t.Fatalf("expected a different line not to be suppressed, got %q", lines[1])
+	}
+}
@@ -3,11 +3,18 @@ package main
 import (
 	"fmt"
 	"log"
-	"strings"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	"github.com/uovobw/uwsgi-metrics-poller/config"
 	etcd "github.com/uovobw/uwsgi-metrics-poller/etcd_watcher"
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
 	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -16,25 +23,91 @@ const (
 )
 
 var (
-	debug               = kingpin.Flag("debug", "enable debug mode.").Short('d').Bool()
+	runCommand          = kingpin.Command("run", "poll the uwsgi hosts and push their metrics").Default()
+	validateCommand     = kingpin.Command("validate-config", "validate a configuration file and exit")
+	validateFile        = validateCommand.Arg("file", "configuration file to validate").Required().String()
+	configFile          = kingpin.Flag("config", "yaml configuration file, its settings override the flags").Short('c').String()
+	configWatchPeriod   = kingpin.Flag("config-watch-period", "how often the configuration file is checked for changes to reload it, 0 to only reload on SIGHUP").Default("10s").Duration()
+	debug               = kingpin.Flag("debug", "log at the debug level, same as --log-level debug").Short('d').Bool()
+	logFormat           = kingpin.Flag("log-format", "format of the log lines: logfmt or json").Default("logfmt").Enum(logging.FormatNames...)
+	logLevel            = kingpin.Flag("log-level", "lowest level logged: debug, info, warn or error").Default("info").Enum(logging.LevelNames...)
+	logRateLimit        = kingpin.Flag("log-rate-limit", "how long the repeated warnings and errors about a host are suppressed, 0 to log them all").Default(logging.DefaultRateLimit.String()).Duration()
+	adminListen         = kingpin.Flag("admin-listen", "address of the admin http server, e.g. 127.0.0.1:8080, disabled if empty").String()
+	adminToken          = kingpin.Flag("admin-token", "token required by the admin requests changing the state of the poller, mandatory unless listening on loopback").String()
+	healthMissed        = kingpin.Flag("health-missed-intervals", "polling or etcd periods without a successful push or etcd read after which the poller is unhealthy").Default("3").Int()
+	shutdownTimeout     = kingpin.Flag("shutdown-timeout", "how long to wait for the running polls and the final push on shutdown").Default("15s").Duration()
 	etcdHosts           = kingpin.Flag("etcd-hosts", "comma separated etcd hosts in the format host:port").Short('e').Default("localhost:4001").Strings()
 	etcdWatchKeys       = kingpin.Flag("etcd-watch-dirs", "comma separated etcd directories to watch for hosts").Short('k').Default("/").Strings()
 	etcdWatchPeriod     = kingpin.Flag("etcd-watch-period", "polling period for the etcd key in seconds").Short('p').Default("30").Int()
+	etcdKeepHosts       = kingpin.Flag("etcd-keep-hosts", "keep polling the last known hosts while etcd cannot be read").Bool()
+	etcdKeyQuarantine   = kingpin.Flag("etcd-key-quarantine", "how long an etcd key that cannot be read or parsed is ignored").Default(etcd.DefaultKeyQuarantine.String()).Duration()
 	uwsgiPollingPeriod  = kingpin.Flag("uwsgi-polling-period", "polling period in seconds for the uwsgi stats").Short('u').Default("30").Int()
 	uwsgiStatsPort      = kingpin.Flag("uwsgi-stats-port", "port to hit for the uwsgi stats").Short('P').Default("12321").Int()
+	maxConcurrentPolls  = kingpin.Flag("uwsgi-max-concurrent-polls", "maximum number of uwsgi hosts polled at the same time").Default("50").Int()
+	uwsgiPollJitter     = kingpin.Flag("uwsgi-poll-jitter", "maximum random shift of each poll of a host").Default("1s").Duration()
+	roundGrace          = kingpin.Flag("round-grace", "how long after the end of a collection round late polls are still counted in it").Default("5s").Duration()
+	uwsgiDialTimeout    = kingpin.Flag("uwsgi-dial-timeout", "timeout connecting to the uwsgi stats server").Default(uwsgi.DefaultOptions.DialTimeout.String()).Duration()
+	uwsgiReadTimeout    = kingpin.Flag("uwsgi-read-timeout", "timeout reading the whole response of the uwsgi stats server").Default(uwsgi.DefaultOptions.ReadTimeout.String()).Duration()
+	uwsgiMaxPayloadSize = kingpin.Flag("uwsgi-max-payload-size", "maximum size in bytes of a uwsgi stats response").Default(fmt.Sprintf("%d", uwsgi.DefaultOptions.MaxPayloadSize)).Int64()
+	failureThreshold    = kingpin.Flag("uwsgi-failure-threshold", "consecutive failed polls after which a host is considered down").Default(fmt.Sprintf("%d", uwsgi.DefaultOptions.FailureThreshold)).Int()
+	backoffInitial      = kingpin.Flag("uwsgi-backoff-initial", "delay before probing again a host that went down").Default(uwsgi.DefaultOptions.Backoff.Initial.String()).Duration()
+	backoffMax          = kingpin.Flag("uwsgi-backoff-max", "maximum delay between probes of a host that is down").Default(uwsgi.DefaultOptions.Backoff.Max.String()).Duration()
+	backoffJitter       = kingpin.Flag("uwsgi-backoff-jitter", "fraction of each backoff delay randomly added or removed").Default(fmt.Sprintf("%g", uwsgi.DefaultOptions.Backoff.Jitter)).Float64()
+	parseErrorPolicy    = kingpin.Flag("uwsgi-parse-error-policy", "what to do with a host whose stats cannot be parsed: skip, backoff or quarantine").Default("skip").Enum(uwsgi.ParseErrorPolicyNames...)
+	maxParseBackoff     = kingpin.Flag("uwsgi-max-parse-backoff", "maximum polling interval of a host backing off after parse errors").Default(uwsgi.DefaultOptions.MaxParseBackoff.String()).Duration()
+	quarantinePeriod    = kingpin.Flag("uwsgi-quarantine-period", "how long a host is not polled after a parse error when quarantining").Default(uwsgi.DefaultOptions.QuarantinePeriod.String()).Duration()
+	badPayloadDir       = kingpin.Flag("uwsgi-bad-payload-dir", "directory where the stats payloads that cannot be parsed are saved").String()
+	availableStates     = kingpin.Flag("available-worker-state", "uwsgi worker status counted as available capacity, can be repeated").Default(uwsgi.DefaultAvailableStates...).Strings()
+	inactiveStates      = kingpin.Flag("inactive-worker-state", "uwsgi worker status not counted as an active worker, can be repeated").Default(uwsgi.DefaultInactiveStates...).Strings()
+	eventWebhookURL     = kingpin.Flag("event-webhook-url", "URL to post the uwsgi poller events to as JSON").String()
+	eventWebhookReasons = kingpin.Flag("event-webhook-reason", "only post events with this reason (e.g. host-is-unreachable), can be repeated").Strings()
+	eventWebhookTimeout = kingpin.Flag("event-webhook-timeout", "timeout posting an event to the webhook").Default("5s").Duration()
+	sinks               = kingpin.Flag("sink", "where to publish the metrics: api (cloudwatch PutMetricData) or emf (embedded metric format documents), can be repeated").Default("api").Enums(cw.SinkNames...)
+	emfOutput           = kingpin.Flag("emf-output", "file the emf documents are written to, - for the standard output").Default(cw.DefaultOptions.EMFOutput).String()
 	awsSecretKey        = kingpin.Flag("aws-secret-key", "AWS account secret").String()
 	awsAccessKey        = kingpin.Flag("aws-access-key", "AWS account key").String()
 	awsRegion           = kingpin.Flag("aws-region", "AWS region in which to log").Default("eu-west-1").String()
 	awsNamespace        = kingpin.Flag("aws-namespace", "AWS namespace name for the cloudwatch metric").String()
 	awsAutoscalingGroup = kingpin.Flag("aws-autoscaling-group", "AWS autoscaling group name").String()
+	awsPerHostMetrics   = kingpin.Flag("aws-per-host-metrics", "also push core utilisation metrics for every host with a host dimension").Bool()
+	awsMinCoverage      = kingpin.Flag("aws-min-coverage", "fraction of the hosts that must report in a round for it to be pushed normally").Default("0").Float64()
+	awsIncompleteRound  = kingpin.Flag("aws-incomplete-round", "what to do with a round below the minimum coverage: flag or skip").Default("flag").Enum(cw.IncompleteRoundPolicyNames...)
+	awsRetryQueue       = kingpin.Flag("aws-retry-queue", "file where the datapoints that failed to be pushed are kept until pushed again").String()
+	awsRetryQueueSize   = kingpin.Flag("aws-retry-queue-size", "maximum number of datapoints waiting to be pushed again").Default(fmt.Sprintf("%d", cw.DefaultOptions.RetryQueueSize)).Int()
+	awsRetryMaxAge      = kingpin.Flag("aws-retry-max-age", "maximum age of a datapoint pushed again, cloudwatch does not accept more than two weeks").Default(cw.DefaultOptions.RetryMaxAge.String()).Duration()
+	awsRetryBackoffMax  = kingpin.Flag("aws-retry-backoff-max", "maximum delay between attempts to push the queued datapoints again").Default(cw.DefaultOptions.RetryBackoff.Max.String()).Duration()
+	staleGrace          = kingpin.Flag("stale-grace", "how long a host that stopped reporting is still taken into account before being forgotten").Default(cw.DefaultOptions.StaleGrace.String()).Duration()
+	awsHostStatistics   = kingpin.Flag("aws-host-statistic", "statistic of the single host values pushed along with each group metric: min, max or average, can be repeated").Enums(cw.StatisticNames...)
+	awsHostValues       = kingpin.Flag("aws-host-values", "how the single host values of each metric are pushed: none, statistic-set or values").Default("none").Enum(cw.HostValuesModeNames...)
+	awsHighResolution   = kingpin.Flag("aws-high-resolution", "push metrics with a one second storage resolution").Bool()
+	selfMetrics         = kingpin.Flag("self-metrics", "also push the metrics about the poller itself through the sinks").Bool()
+	stalePolicy         = kingpin.Flag("stale-policy", "how a host that stopped reporting is taken into account: exclude, zero or carry").Default("exclude").Enum(cw.StalePolicyNames...)
 
-	cloudwatchPusher *cw.CloudWatchPusher
-	etcdWatchers     map[string]*etcd.EtcdWatcher
-	etcdEventsChan   chan *etcd.EtcdEvent
-	uwsgiStatsChan   chan *uwsgi.UwsgiStats
-	uwsgiEventsChan  chan *uwsgi.UwsgiEvent
-	quitChan         chan int
-	err              error
+	// stateLock guards the configuration, the pushers, the etcd watchers and
+	// the webhook, they are replaced on reload while the stats and events
+	// keep flowing. the etcd watchers are only changed by the goroutine
+	// handling the etcd events, which reads them without it
+	stateLock       sync.RWMutex
+	cfg             *config.Config
+	pushers         map[string]*cw.CloudWatchPusher
+	webhook         *uwsgi.WebhookHandler
+	reloadChan      chan int
+	rediscoverChan  chan int
+	runCtx          context.Context // done when the poller shuts down
+	startTime       time.Time
+	etcdWatchers    map[string]*etcd.EtcdWatcher
+	etcdEventsChan  chan *etcd.EtcdEvent
+	uwsgiStatsChan  chan *uwsgi.UwsgiStats
+	uwsgiEventsChan chan *uwsgi.UwsgiEvent
+	// uwsgiPollers are the pollers by the address they poll, as the
+	// scheduler knows them, discoveredHosts the address polled for every
+	// host of every etcd directory. several hosts may share an address
+	uwsgiPollers    map[string]*uwsgi.UwsgiPoller
+	discoveredHosts map[string]map[string]string
+	uwsgiScheduler  *uwsgi.Scheduler
+	eventDispatcher *uwsgi.EventDispatcher
+	err             error
+	logger          = logging.New("main")
 )
 
 func init() {
@@ -42,83 +115,435 @@ func init() {
 	etcdEventsChan = make(chan *etcd.EtcdEvent, 100)
 	uwsgiStatsChan = make(chan *uwsgi.UwsgiStats, 100)
 	uwsgiEventsChan = make(chan *uwsgi.UwsgiEvent, 100)
-	quitChan = make(chan int)
+	uwsgiPollers = make(map[string]*uwsgi.UwsgiPoller, 100)
+	discoveredHosts = make(map[string]map[string]string)
+	pushers = make(map[string]*cw.CloudWatchPusher)
+	reloadChan = make(chan int, 1)
+	rediscoverChan = make(chan int, 1)
+	eventDispatcher = &uwsgi.EventDispatcher{}
 }
 
-func getUwsgiStatsConnectionString(host string) string {
-	parts := strings.Split(host, ":")
-	if len(parts) != 2 {
-		panic(fmt.Sprintf("received host specification different from <host>:<port> (was %s). aborting", host))
+func getUwsgiStatsConnectionString(host string) (string, error) {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", fmt.Errorf("received host specification different from <host>:<port> (was %s): %s", host, err)
+	}
+	return net.JoinHostPort(h, strconv.Itoa(cfg.Discovery.StatsPort)), nil
+}
+
+// configFromFlags builds the configuration out of the command line flags,
+// with a single aggregation group covering all the etcd directories
+func configFromFlags() *config.Config {
+	c := &config.Config{
+		Debug:           *debug,
+		ShutdownTimeout: *shutdownTimeout,
+		Discovery: config.DiscoveryConfig{
+			Etcd: config.EtcdConfig{
+				Hosts:            *etcdHosts,
+				Dirs:             *etcdWatchKeys,
+				Period:           time.Duration(*etcdWatchPeriod) * time.Second,
+				KeepHostsOnError: *etcdKeepHosts,
+				KeyQuarantine:    *etcdKeyQuarantine,
+			},
+			StatsPort: *uwsgiStatsPort,
+		},
+		Polling: config.PollingConfig{
+			Period:             time.Duration(*uwsgiPollingPeriod) * time.Second,
+			MaxConcurrentPolls: *maxConcurrentPolls,
+			Jitter:             *uwsgiPollJitter,
+			RoundGrace:         *roundGrace,
+			DialTimeout:        *uwsgiDialTimeout,
+			ReadTimeout:        *uwsgiReadTimeout,
+			MaxPayloadSize:     *uwsgiMaxPayloadSize,
+			FailureThreshold:   *failureThreshold,
+			Backoff: config.BackoffConfig{
+				Initial: *backoffInitial,
+				Max:     *backoffMax,
+				Jitter:  *backoffJitter,
+			},
+			ParseErrorPolicy:      *parseErrorPolicy,
+			MaxParseBackoff:       *maxParseBackoff,
+			QuarantinePeriod:      *quarantinePeriod,
+			BadPayloadDir:         *badPayloadDir,
+			AvailableWorkerStates: *availableStates,
+			InactiveWorkerStates:  *inactiveStates,
+		},
+		Events: config.EventsConfig{
+			Webhook: config.WebhookConfig{
+				URL:     *eventWebhookURL,
+				Reasons: *eventWebhookReasons,
+				Timeout: *eventWebhookTimeout,
+			},
+		},
+		Logging: config.LogConfig{
+			Format:    *logFormat,
+			Level:     *logLevel,
+			RateLimit: *logRateLimit,
+		},
+		Admin: config.AdminConfig{
+			Listen:                *adminListen,
+			Token:                 *adminToken,
+			HealthMissedIntervals: *healthMissed,
+		},
+		AWS: config.AWSConfig{
+			AccessKey: *awsAccessKey,
+			SecretKey: *awsSecretKey,
+			Region:    *awsRegion,
+			Namespace: *awsNamespace,
+		},
+		Aggregation: config.AggregationConfig{
+			Groups: []config.GroupConfig{
+				{Name: *awsAutoscalingGroup},
+			},
+			PerHostMetrics:  *awsPerHostMetrics,
+			MinCoverage:     *awsMinCoverage,
+			IncompleteRound: *awsIncompleteRound,
+			StaleGrace:      *staleGrace,
+			StalePolicy:     *stalePolicy,
+			HostStatistics:  *awsHostStatistics,
+			HostValues:      *awsHostValues,
+			HighResolution:  *awsHighResolution,
+			SelfMetrics:     *selfMetrics,
+		},
+	}
+	for _, name := range *sinks {
+		c.Sinks = append(c.Sinks, config.SinkConfig{
+			Type:            name,
+			Output:          *emfOutput,
+			RetryQueue:      *awsRetryQueue,
+			RetryQueueSize:  *awsRetryQueueSize,
+			RetryMaxAge:     *awsRetryMaxAge,
+			RetryBackoffMax: *awsRetryBackoffMax,
+		})
+	}
+	return c
+}
+
+// pusherOf returns the pusher of the aggregation group the hosts of an etcd
+// directory belong to
+func pusherOf(dir string) (*cw.CloudWatchPusher, bool) {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	group, ok := cfg.GroupOf(dir)
+	if !ok {
+		return nil, false
+	}
+	p, ok := pushers[group]
+	return p, ok
+}
+
+// groupRound narrows a round to the hosts of an aggregation group, so that
+// its coverage only counts them. stateLock must be held
+func groupRound(r *uwsgi.Round, group string) *uwsgi.Round {
+	return r.Select(func(labels map[string]string) bool {
+		g, ok := cfg.GroupOf(labels["etcd_dir"])
+		return ok && g == group
+	})
+}
+
+func validateConfig(path string) {
+	err := config.Load(path, configFromFlags())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", path)
+}
+
+// startPusher starts the pusher of an aggregation group, continuing from
+// the state of the stopped pusher it replaces if any. the old pusher is
+// swapped with the new one at once, so that the stats and rounds of the
+// group always find a pusher
+func startPusher(c *config.Config, group config.GroupConfig, old *cw.CloudWatchPusher) error {
+	pusher, err := cw.New(c.AWS.AccessKey, c.AWS.SecretKey, c.AWS.Region, c.PusherOptions(group))
+	if err != nil {
+		return err
+	}
+	pusher.SetSelfMetrics(newSelfMetrics(group.Name))
+	stateLock.Lock()
+	if old != nil {
+		pusher.TakeOver(old)
+	}
+	pushers[group.Name] = pusher
+	stateLock.Unlock()
+	go pusher.Run()
+	return nil
+}
+
+// startWatcher starts watching an etcd directory, starting from the given
+// hosts if it replaces another watcher
+func startWatcher(dir string, seed []string) error {
+	watcher, err := etcd.NewEtcdWatcher(cfg.Discovery.Etcd.Hosts, dir, int(cfg.Discovery.Etcd.Period/time.Second), etcdEventsChan)
+	if err != nil {
+		return err
+	}
+	watcher.KeepHostsOnError = cfg.Discovery.Etcd.KeepHostsOnError
+	watcher.KeyQuarantine = cfg.Discovery.Etcd.KeyQuarantine
+	if seed != nil {
+		watcher.Seed(seed)
+	}
+	go watcher.Run(runCtx)
+	stateLock.Lock()
+	etcdWatchers[dir] = watcher
+	stateLock.Unlock()
+	return nil
+}
+
+// applyLogging sets up the logging as configured, the levels set through the
+// admin server are reset
+func applyLogging(c *config.Config) {
+	format, _ := logging.FormatFromString(c.Logging.Format)
+	level, _ := logging.LevelFromString(c.Logging.Level)
+	if c.Debug {
+		level = logging.DEBUG
+	}
+	logging.SetFormat(format)
+	logging.SetDefaultLevel(level)
+	logging.SetRateLimit(c.Logging.RateLimit)
+	logging.ResetLevels()
+	for component, name := range c.Logging.Levels {
+		level, _ := logging.LevelFromString(name)
+		logging.SetLevel(component, level)
+	}
+}
+
+func handleEtcdEvent(evt *etcd.EtcdEvent) {
+	logger.Debugf("received event from etcd watcher %s", evt)
+	if watcher, ok := etcdWatchers[evt.Dir]; !ok || watcher != evt.Watcher {
+		// late event of a watcher stopped since, a directory no longer
+		// watched or a watcher replaced, whose hosts were handed over to
+		// its replacement
+		return
+	}
+	switch evt.Reason {
+	case etcd.HOST_ADDED:
+		addHost(evt.Dir, evt.Data.(string))
+	case etcd.HOST_REMOVED:
+		logger.Infof("host removed %s", evt)
+		forgetHost(evt.Dir, evt.Data.(string))
+	case etcd.HOST_PARSE_ERROR, etcd.ETCD_KEY_ERROR:
+		// the watcher quarantines the key, the other hosts are unaffected
+		logger.Warnf("ignoring etcd key: %s", evt)
+	case etcd.ETCD_UNREACHABLE, etcd.ETCD_DIR_ERROR:
+		// the watcher retries at its next period
+		logger.Errorf("etcd directory %s cannot be read: %s", evt.Dir, evt)
+	}
+}
+
+// addHost starts polling a host discovered in an etcd directory, unless its
+// address is already polled for another host
+func addHost(dir, host string) {
+	if _, ok := discoveredHosts[dir][host]; ok {
+		return
+	}
+	addr, err := getUwsgiStatsConnectionString(host)
+	if err != nil {
+		logger.Warnf("ignoring host: %s", err)
+		return
+	}
+	if discoveredHosts[dir] == nil {
+		discoveredHosts[dir] = make(map[string]string)
+	}
+	discoveredHosts[dir][host] = addr
+	if _, ok := uwsgiPollers[addr]; ok {
+		logger.Infof("host %s of %s is already polled at %s", host, dir, addr)
+		return
 	}
-	return fmt.Sprintf("%s:%d", parts[0], *uwsgiStatsPort)
+	if !startPoller(dir, addr) {
+		delete(discoveredHosts[dir], host)
+	}
+}
+
+// startPoller starts polling an address for the hosts of an etcd directory
+func startPoller(dir, addr string) bool {
+	labels := map[string]string{"etcd_dir": dir}
+	p, err := uwsgi.New(addr, labels, cfg.Polling.Period, cfg.PollerOptions(), uwsgiStatsChan, uwsgiEventsChan)
+	if err != nil {
+		logger.Errorf("error creating new uwsgi poller for %s: %s", addr, err)
+		return false
+	}
+	uwsgiScheduler.Add(p)
+	uwsgiPollers[addr] = p
+	return true
+}
+
+// forgetHost forgets a host that left an etcd directory, its address stops
+// being polled once no other host is polled at it. when the address is still
+// listed in another directory and was polled for this one, it is polled
+// again for the other directory so that its stats reach the right group
+func forgetHost(dir, host string) {
+	addr, ok := discoveredHosts[dir][host]
+	if !ok {
+		return
+	}
+	delete(discoveredHosts[dir], host)
+	if len(discoveredHosts[dir]) == 0 {
+		delete(discoveredHosts, dir)
+	}
+	owner := ""
+	for other, hosts := range discoveredHosts {
+		for _, a := range hosts {
+			if a == addr && (owner == "" || other < owner) {
+				owner = other
+			}
+		}
+	}
+	if owner == "" {
+		removeHost(addr)
+		return
+	}
+	p, ok := uwsgiPollers[addr]
+	if !ok || p.Labels["etcd_dir"] != dir {
+		return
+	}
+	logger.Infof("address %s left %s, polling it for %s", addr, dir, owner)
+	removeHost(addr)
+	startPoller(owner, addr)
+}
+
+// knownHosts returns the hosts of an etcd directory that are being polled,
+// a watcher replacing another one starts from them
+func knownHosts(dir string) []string {
+	hosts := make([]string, 0, len(discoveredHosts[dir]))
+	for host := range discoveredHosts[dir] {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// removeHost stops polling an address and forgets it
+func removeHost(addr string) {
+	p, ok := uwsgiPollers[addr]
+	if !ok {
+		return
+	}
+	uwsgiScheduler.Remove(p.Target)
+	if pusher, ok := pusherOf(p.Labels["etcd_dir"]); ok {
+		pusher.RemoveHost(p.Target, p.Generation)
+	}
+	delete(uwsgiPollers, addr)
 }
 
 func main() {
 	kingpin.Version(version)
 	kingpin.CommandLine.HelpFlag.Short('h')
-	kingpin.Parse()
-
-	defer log.Println("terminating")
+	command := kingpin.Parse()
 
-	log.Printf("starting uwsgi poller (%s)", version)
-	if *debug {
-		log.Printf("running against etcd host(s) %s with key %s period %d uwsgi polling time %d uwsgi port %d", *etcdHosts, *etcdWatchKeys, *etcdWatchPeriod, *uwsgiPollingPeriod, *uwsgiStatsPort)
+	if command == validateCommand.FullCommand() {
+		validateConfig(*validateFile)
+		return
 	}
 
-	cloudwatchPusher, err = cw.New(*awsAccessKey, *awsSecretKey, *awsRegion, *awsNamespace, *awsAutoscalingGroup)
+	// whatever is still logged with the standard logger, e.g. by the
+	// libraries, is logged as the main component
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.INFO))
+
+	startTime = time.Now()
+	cfg = configFromFlags()
+	err = config.Load(*configFile, cfg)
 	if err != nil {
-		log.Fatalf("cannot create cloudwatch pusher: %s", err)
+		logger.Fatalf("invalid configuration:\n%s", err)
+	}
+	applyLogging(cfg)
+
+	logger.Infof("starting uwsgi poller (%s)", version)
+	logger.Debugf("running against etcd host(s) %s with key %s period %s uwsgi polling time %s uwsgi port %d", cfg.Discovery.Etcd.Hosts, cfg.Discovery.Etcd.Dirs, cfg.Discovery.Etcd.Period, cfg.Polling.Period, cfg.Discovery.StatsPort)
+
+	classifier, _ := uwsgi.NewWorkerClassifier(cfg.Polling.AvailableWorkerStates, cfg.Polling.InactiveWorkerStates)
+	uwsgi.SetWorkerClassifier(classifier)
+
+	if cfg.Polling.Period < time.Minute && !cfg.Aggregation.HighResolution {
+		logger.Warnf("polling every %s without high resolution metrics, cloudwatch will only keep one value per minute", cfg.Polling.Period)
 	}
-	go cloudwatchPusher.Run()
 
-	for _, key := range *etcdWatchKeys {
-		watcher, err := etcd.NewEtcdWatcher(*etcdHosts, key, *etcdWatchPeriod, etcdEventsChan)
+	var stop context.CancelFunc
+	runCtx, stop = context.WithCancel(context.Background())
+
+	uwsgiScheduler = uwsgi.NewScheduler(cfg.Polling.Period, cfg.Polling.MaxConcurrentPolls, cfg.Polling.Jitter, cfg.Polling.RoundGrace)
+	for _, group := range cfg.Aggregation.Groups {
+		err := startPusher(cfg, group, nil)
 		if err != nil {
-			log.Fatalf("could not initialize etcd watcher: %s", err)
+			logger.Fatalf("cannot create cloudwatch pusher for group %s: %s", group.Name, err)
 		}
-		go watcher.Run()
-		etcdWatchers[key] = watcher
 	}
+	uwsgiScheduler.OnRoundClose(func(r *uwsgi.Round) {
+		stateLock.RLock()
+		defer stateLock.RUnlock()
+		for name, pusher := range pushers {
+			pusher.CloseRound(groupRound(r, name))
+		}
+	})
+	go uwsgiScheduler.Run()
 
-	// handle events from the etcd watcher
+	eventDispatcher.Register(uwsgi.LogHandler)
+	// every pusher only follows the events of the hosts of its group
+	eventDispatcher.Register(uwsgi.EventHandlerFunc(func(e *uwsgi.UwsgiEvent) {
+		if pusher, ok := pusherOf(e.Labels["etcd_dir"]); ok {
+			pusher.HandleEvent(e)
+		}
+	}))
+	webhook = newWebhook(cfg)
+	eventDispatcher.Register(uwsgi.EventHandlerFunc(func(e *uwsgi.UwsgiEvent) {
+		stateLock.RLock()
+		h := webhook
+		stateLock.RUnlock()
+		if h != nil {
+			h.HandleEvent(e)
+		}
+	}))
+
+	for _, key := range cfg.Discovery.Etcd.Dirs {
+		err := startWatcher(key, nil)
+		if err != nil {
+			logger.Fatalf("could not initialize etcd watcher: %s", err)
+		}
+	}
+
+	watchReloads()
+	startAdmin()
+
+	// handle events from the etcd watcher and configuration reloads, one at
+	// a time so that a reload never races with a host being added
+	etcdDone := make(chan int)
 	go func(evtChan chan *etcd.EtcdEvent) {
-		for evt := range evtChan {
-			log.Printf("received event from etcd watcher %s", evt)
-			switch evt.Reason {
-			case etcd.HOST_ADDED:
-				p, err := uwsgi.New(getUwsgiStatsConnectionString(evt.Data.(string)), *uwsgiPollingPeriod, uwsgiStatsChan, uwsgiEventsChan, quitChan)
-				if err != nil {
-					log.Printf("error creating new uwsgi poller for %s", evt)
+		defer close(etcdDone)
+		for {
+			select {
+			case evt := <-evtChan:
+				handleEtcdEvent(evt)
+			case <-reloadChan:
+				reload()
+			case <-rediscoverChan:
+				for _, watcher := range etcdWatchers {
+					watcher.Refresh()
 				}
-				p.Run()
-			case etcd.HOST_REMOVED:
-				log.Printf("host removed %s", evt)
-			case etcd.HOST_PARSE_ERROR:
-				log.Fatalf("unexpected format in host string %s aborting", evt)
-			case etcd.ETCD_UNREACHABLE:
-				log.Fatalf("cannot reach etcd host(s), aborting")
-			case etcd.ETCD_DIR_ERROR:
-				log.Fatalf("directory error, aborting: %s", evt)
-			case etcd.ETCD_KEY_ERROR:
-				log.Fatalf("key value error, aborting: %s", evt)
+			case <-runCtx.Done():
+				return
 			}
 		}
 	}(etcdEventsChan)
 
 	// handle events from uwsgi pollers
-	go func(evtChan chan *uwsgi.UwsgiEvent) {
-		for uwsgiEvent := range evtChan {
-			log.Printf("received event from uwsgi poller: %s", uwsgiEvent)
-		}
-	}(uwsgiEventsChan)
+	eventsDone := make(chan int)
+	go func() {
+		defer close(eventsDone)
+		eventDispatcher.Run(uwsgiEventsChan)
+	}()
 
 	// handle stats coming from the uwsgi pollers
+	statsDone := make(chan int)
 	go func(statsChan chan *uwsgi.UwsgiStats) {
+		defer close(statsDone)
 		for stat := range statsChan {
-			//log.Printf("received stats from uwsgi poller: %s", stat)
-			cloudwatchPusher.HandleStat(stat)
+			logger.Debugf("received stats from uwsgi poller: %s", stat)
+			if pusher, ok := pusherOf(stat.Labels["etcd_dir"]); ok {
+				pusher.HandleStat(stat)
+			}
 		}
 	}(uwsgiStatsChan)
 
-	select {}
+	code := waitForShutdown(stop, etcdDone, statsDone, eventsDone)
+	logger.Infof("terminating with exit code %d", code)
+	os.Exit(code)
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uovobw/uwsgi-metrics-poller/config"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+func TestSharedAddressFollowsRemainingDirectory(t *testing.T) {
+	cfg = &config.Config{}
+	cfg.Discovery.StatsPort = 12321
+	cfg.Polling.Period = time.Minute
+	uwsgiScheduler = uwsgi.NewScheduler(time.Minute, 1, 0, 0)
+	uwsgiPollers = make(map[string]*uwsgi.UwsgiPoller)
+	discoveredHosts = make(map[string]map[string]string)
+
+	addHost("/a", "127.0.0.1:80")
+	addHost("/b", "127.0.0.1:8080")
+	if len(uwsgiPollers) != 1 {
+		t.Fatalf("expected a single poller for the shared address, got %d", len(uwsgiPollers))
+	}
+	p := uwsgiPollers["127.0.0.1:12321"]
+	if p.Labels["etcd_dir"] != "/a" {
+		t.Fatalf("expected the address to be polled for /a, got %s", p.Labels["etcd_dir"])
+	}
+
+	forgetHost("/a", "127.0.0.1:80")
+	p, ok := uwsgiPollers["127.0.0.1:12321"]
+	if !ok {
+		t.Fatal("expected the address still listed in /b to be polled")
+	}
+	if p.Labels["etcd_dir"] != "/b" {
+		t.Fatalf("expected the address to be polled for /b, got %s", p.Labels["etcd_dir"])
+	}
+
+	forgetHost("/b", "127.0.0.1:8080")
+	if len(uwsgiPollers) != 0 || len(discoveredHosts) != 0 {
+		t.Fatalf("expected nothing polled once both hosts left, got %v %v", uwsgiPollers, discoveredHosts)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	"github.com/uovobw/uwsgi-metrics-poller/config"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
+)
+
+func newWebhook(c *config.Config) *uwsgi.WebhookHandler {
+	if c.Events.Webhook.URL == "" {
+		return nil
+	}
+	return uwsgi.NewWebhookHandler(c.Events.Webhook.URL, c.WebhookReasons(), c.Events.Webhook.Timeout)
+}
+
+// requestReload asks for the configuration to be reloaded, requests coming
+// while one is already pending are merged into it
+func requestReload() {
+	select {
+	case reloadChan <- 1:
+	default:
+	}
+}
+
+// watchReloads reloads the configuration on SIGHUP and, when a file is
+// used, whenever it changes
+func watchReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Infof("received SIGHUP, reloading configuration")
+			requestReload()
+		}
+	}()
+	if *configFile == "" || *configWatchPeriod <= 0 {
+		return
+	}
+	go func() {
+		var lastMod time.Time
+		var lastSize int64
+		info, err := os.Stat(*configFile)
+		if err == nil {
+			lastMod, lastSize = info.ModTime(), info.Size()
+		}
+		for range time.Tick(*configWatchPeriod) {
+			info, err := os.Stat(*configFile)
+			if err != nil {
+				logger.Errorf("error checking configuration file %s: %s", *configFile, err)
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			logger.Infof("configuration file %s changed, reloading it", *configFile)
+			requestReload()
+		}
+	}()
+}
+
+// keepRestartOnly keeps in the new configuration the settings that cannot
+// change without a restart, warning about the ones that were changed
+func keepRestartOnly(old, c *config.Config) {
+	restartOnly := []struct {
+		name string
+		old  interface{}
+		new  interface{}
+	}{
+		{"polling.period", &old.Polling.Period, &c.Polling.Period},
+		{"polling.max_concurrent_polls", &old.Polling.MaxConcurrentPolls, &c.Polling.MaxConcurrentPolls},
+		{"polling.jitter", &old.Polling.Jitter, &c.Polling.Jitter},
+		{"polling.round_grace", &old.Polling.RoundGrace, &c.Polling.RoundGrace},
+		{"polling.available_worker_states", &old.Polling.AvailableWorkerStates, &c.Polling.AvailableWorkerStates},
+		{"polling.inactive_worker_states", &old.Polling.InactiveWorkerStates, &c.Polling.InactiveWorkerStates},
+		{"discovery.stats_port", &old.Discovery.StatsPort, &c.Discovery.StatsPort},
+		{"admin.listen", &old.Admin.Listen, &c.Admin.Listen},
+	}
+	for _, s := range restartOnly {
+		oldValue := reflect.ValueOf(s.old).Elem()
+		newValue := reflect.ValueOf(s.new).Elem()
+		if !reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			logger.Warnf("changes to %s need a restart, keeping %v", s.name, oldValue.Interface())
+			newValue.Set(oldValue)
+		}
+	}
+	if !reflect.DeepEqual(old.PollerOptions(), c.PollerOptions()) {
+		logger.Warnf("polling settings changed, they only apply to the hosts discovered from now on")
+	}
+}
+
+// reload applies a new configuration without losing the state of what did
+// not change: the pollers of the hosts still discovered keep running and
+// the pushers of the groups whose settings did not change keep their state.
+// an invalid configuration is ignored
+func reload() {
+	c := configFromFlags()
+	err := config.Load(*configFile, c)
+	if err != nil {
+		logger.Errorf("not reloading invalid configuration:\n%s", err)
+		return
+	}
+	old := cfg
+	keepRestartOnly(old, c)
+
+	// the pushers whose options changed are replaced, taking over the state
+	// of the old ones
+	oldGroups := make(map[string]config.GroupConfig)
+	for _, group := range old.Aggregation.Groups {
+		oldGroups[group.Name] = group
+	}
+	newGroups := make(map[string]config.GroupConfig)
+	for _, group := range c.Aggregation.Groups {
+		newGroups[group.Name] = group
+	}
+	stopped := make(map[string]*cw.CloudWatchPusher)
+	stateLock.Lock()
+	for name, pusher := range pushers {
+		group, ok := newGroups[name]
+		if ok && reflect.DeepEqual(old.PusherOptions(oldGroups[name]), c.PusherOptions(group)) {
+			continue
+		}
+		stopped[name] = pusher
+	}
+	// hosts moving to another group are forgotten by the pusher they leave
+	for _, p := range uwsgiPollers {
+		dir := p.Labels["etcd_dir"]
+		from, _ := old.GroupOf(dir)
+		to, _ := c.GroupOf(dir)
+		if pusher, ok := pushers[from]; ok && from != to {
+			pusher.RemoveHost(p.Target, p.Generation)
+		}
+	}
+	cfg = c
+	oldWebhook := webhook
+	webhook = newWebhook(c)
+	stateLock.Unlock()
+	if oldWebhook != nil {
+		// the old webhook posts what it queued in the background
+		go oldWebhook.Close(context.Background())
+	}
+	applyLogging(c)
+	// the stopped pushers stay in place, collecting the stats and rounds of
+	// their group, until their replacement takes over from them
+	for name, pusher := range stopped {
+		logger.Infof("stopping pusher of group %s", name)
+		err := pusher.Stop(context.Background())
+		if err != nil {
+			logger.Errorf("error flushing the pusher of group %s: %s", name, err)
+		}
+	}
+	for _, group := range c.Aggregation.Groups {
+		stateLock.RLock()
+		_, running := pushers[group.Name]
+		stateLock.RUnlock()
+		if running && stopped[group.Name] == nil {
+			continue
+		}
+		logger.Infof("starting pusher of group %s", group.Name)
+		err := startPusher(c, group, stopped[group.Name])
+		if err == nil {
+			delete(stopped, group.Name)
+			continue
+		}
+		logger.Errorf("cannot create cloudwatch pusher for group %s: %s", group.Name, err)
+		previous, ok := oldGroups[group.Name]
+		if !ok || stopped[group.Name] == nil {
+			continue
+		}
+		// keep pushing the group with its previous settings
+		err = startPusher(old, previous, stopped[group.Name])
+		if err != nil {
+			logger.Errorf("cannot restore cloudwatch pusher for group %s: %s", group.Name, err)
+			continue
+		}
+		delete(stopped, group.Name)
+	}
+	// the pushers of the groups that are gone, or that could not be
+	// replaced, are dropped
+	stateLock.Lock()
+	for name := range stopped {
+		delete(pushers, name)
+	}
+	stateLock.Unlock()
+
+	// watchers are restarted from the hosts they know when etcd changes,
+	// removed directories stop being watched along with their hosts
+	oldEtcd, newEtcd := old.Discovery.Etcd, c.Discovery.Etcd
+	oldEtcd.Dirs, newEtcd.Dirs = nil, nil
+	etcdChanged := !reflect.DeepEqual(oldEtcd, newEtcd)
+	dirs := make(map[string]bool)
+	for _, dir := range c.Discovery.Etcd.Dirs {
+		dirs[dir] = true
+	}
+	restarted := make([]string, 0)
+	removed := make([]string, 0)
+	added := make([]string, 0)
+	for dir := range etcdWatchers {
+		if !dirs[dir] {
+			removed = append(removed, dir)
+		} else if etcdChanged {
+			restarted = append(restarted, dir)
+		}
+	}
+	for dir := range dirs {
+		if _, ok := etcdWatchers[dir]; !ok {
+			added = append(added, dir)
+		}
+	}
+	// the events still queued from the stopped watchers are ignored, the
+	// restarted ones start from the hosts being polled instead
+	for _, dir := range restarted {
+		logger.Infof("restarting etcd watcher on directory %s", dir)
+		etcdWatchers[dir].Stop()
+		err := startWatcher(dir, knownHosts(dir))
+		if err != nil {
+			logger.Errorf("could not restart etcd watcher on directory %s: %s", dir, err)
+			stateLock.Lock()
+			delete(etcdWatchers, dir)
+			stateLock.Unlock()
+		}
+	}
+	for _, dir := range removed {
+		logger.Infof("no longer watching etcd directory %s", dir)
+		etcdWatchers[dir].Stop()
+		stateLock.Lock()
+		delete(etcdWatchers, dir)
+		stateLock.Unlock()
+		for _, host := range knownHosts(dir) {
+			forgetHost(dir, host)
+		}
+	}
+	for _, dir := range added {
+		logger.Infof("watching new etcd directory %s", dir)
+		err := startWatcher(dir, nil)
+		if err != nil {
+			logger.Errorf("could not initialize etcd watcher on directory %s: %s", dir, err)
+		}
+	}
+	logger.Infof("configuration reloaded")
+}
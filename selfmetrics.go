@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+)
+
+// pollerMetrics is the state of the poller itself, as shown by the admin
+// server. counters are totals since the poller, or the pusher of a group,
+// started
+type pollerMetrics struct {
+	Targets     map[string]int          `json:"targets"`
+	Pollers     int                     `json:"pollers"`
+	PollLatency uwsgi.HistogramSnapshot `json:"poll_latency_ms"`
+	PollLag     uwsgi.HistogramSnapshot `json:"poll_lag_ms"`
+	Polls       uwsgi.PollCounts        `json:"polls"`
+	Backlog     map[string]int          `json:"backlog"`
+	// WebhookDropped is the number of events the webhook could not keep
+	// up with
+	WebhookDropped int64                    `json:"webhook_dropped_events"`
+	Groups         map[string]*groupMetrics `json:"groups"`
+}
+
+// groupMetrics is the state of the pusher of an aggregation group
+type groupMetrics struct {
+	Sinks             map[string]cw.SinkStats `json:"sinks"`
+	DroppedRounds     int64                   `json:"dropped_rounds"`
+	DroppedDatapoints int64                   `json:"dropped_datapoints"`
+}
+
+func newGroupMetrics(pusher *cw.CloudWatchPusher) *groupMetrics {
+	rounds, datapoints := pusher.Dropped()
+	return &groupMetrics{
+		Sinks:             pusher.SinkStats(),
+		DroppedRounds:     rounds,
+		DroppedDatapoints: datapoints,
+	}
+}
+
+// targetsBySource returns the number of hosts discovered in every etcd
+// directory
+func targetsBySource() map[string]int {
+	targets := make(map[string]int)
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	for dir, watcher := range etcdWatchers {
+		targets[dir] = len(watcher.Hosts())
+	}
+	return targets
+}
+
+func backlog() map[string]int {
+	return map[string]int{
+		"stats":       len(uwsgiStatsChan),
+		"etcd-events": len(etcdEventsChan),
+		"events":      len(uwsgiEventsChan),
+	}
+}
+
+func currentPollerMetrics() *pollerMetrics {
+	m := &pollerMetrics{
+		Targets:        targetsBySource(),
+		Pollers:        len(uwsgiScheduler.Pollers()),
+		PollLatency:    uwsgiScheduler.Stats.Latency.Snapshot(),
+		PollLag:        uwsgiScheduler.Stats.Lag.Snapshot(),
+		Polls:          uwsgiScheduler.Stats.Counts(),
+		Backlog:        backlog(),
+		WebhookDropped: uwsgi.WebhookDropped(),
+		Groups:         make(map[string]*groupMetrics),
+	}
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	for group, pusher := range pushers {
+		m.Groups[group] = newGroupMetrics(pusher)
+	}
+	return m
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, currentPollerMetrics())
+}
+
+// processMetrics holds what the process wide metrics were at the previous
+// push, they are pushed by a single group at a time
+var processMetrics = struct {
+	sync.Mutex
+	latency        uwsgi.HistogramSnapshot
+	lag            uwsgi.HistogramSnapshot
+	polls          uwsgi.PollCounts
+	webhookDropped int64
+}{}
+
+// selfMetricsAdder collects self metrics, dimensions are given as a name and
+// value pair
+type selfMetricsAdder struct {
+	metrics []cw.SelfMetric
+	global  bool
+}
+
+func (a *selfMetricsAdder) add(name, unit string, value float64, dimensions ...string) {
+	m := cw.SelfMetric{Name: "poller-" + name, Unit: unit, Value: value, Global: a.global}
+	if len(dimensions) == 2 {
+		m.Dimensions = map[string]string{dimensions[0]: dimensions[1]}
+	}
+	a.metrics = append(a.metrics, m)
+}
+
+func (a *selfMetricsAdder) addLatency(name string, latency uwsgi.HistogramSnapshot, dimensions ...string) {
+	if latency.Count == 0 {
+		return
+	}
+	a.add(name+"-average", "Milliseconds", latency.Mean(), dimensions...)
+	a.add(name+"-p90", "Milliseconds", latency.Quantile(0.9), dimensions...)
+}
+
+// addProcessMetrics adds the metrics about the whole process: the pollers,
+// the backlog and the polls made since the previous push
+func addProcessMetrics(a *selfMetricsAdder) {
+	processMetrics.Lock()
+	defer processMetrics.Unlock()
+	a.add("active-pollers", "Count", float64(len(uwsgiScheduler.Pollers())))
+	for name, n := range backlog() {
+		a.add("backlog", "Count", float64(n), "channel", name)
+	}
+	latency := uwsgiScheduler.Stats.Latency.Snapshot()
+	lag := uwsgiScheduler.Stats.Lag.Snapshot()
+	polls := uwsgiScheduler.Stats.Counts()
+	prev := processMetrics.polls
+	a.addLatency("poll-latency", latency.Sub(processMetrics.latency))
+	a.addLatency("poll-lag", lag.Sub(processMetrics.lag))
+	a.add("late-polls", "Count", float64(polls.LatePolls-prev.LatePolls))
+	a.add("polls", "Count", float64(polls.Polls-prev.Polls))
+	for kind, n := range polls.Errors {
+		a.add("poll-errors", "Count", float64(n-prev.Errors[kind]), "kind", kind)
+	}
+	a.add("parse-errors", "Count", float64(polls.ParseErrors-prev.ParseErrors))
+	webhookDropped := uwsgi.WebhookDropped()
+	a.add("webhook-dropped-events", "Count", float64(webhookDropped-processMetrics.webhookDropped))
+	processMetrics.latency, processMetrics.lag, processMetrics.polls = latency, lag, polls
+	processMetrics.webhookDropped = webhookDropped
+}
+
+// newSelfMetrics returns the function providing the metrics about the
+// poller pushed with the rounds of a group. counters are pushed as the
+// difference from the previous push and latencies as the average and the
+// 90th percentile of the polls and pushes made since then. the metrics
+// about the whole process are only pushed with the first group, without
+// the group dimension
+func newSelfMetrics(group string) func(c *cw.CloudWatchPusher) []cw.SelfMetric {
+	prevGroup := &groupMetrics{Sinks: make(map[string]cw.SinkStats)}
+	return func(c *cw.CloudWatchPusher) []cw.SelfMetric {
+		a := &selfMetricsAdder{metrics: make([]cw.SelfMetric, 0)}
+		stateLock.RLock()
+		for dir, watcher := range etcdWatchers {
+			if g, _ := cfg.GroupOf(dir); g == group {
+				a.add("targets", "Count", float64(len(watcher.Hosts())), "source", dir)
+			}
+		}
+		first := len(cfg.Aggregation.Groups) > 0 && cfg.Aggregation.Groups[0].Name == group
+		stateLock.RUnlock()
+
+		current := newGroupMetrics(c)
+		for name, stats := range current.Sinks {
+			prev := prevGroup.Sinks[name]
+			a.addLatency("sink-push-latency", stats.Latency.Sub(prev.Latency), "sink", name)
+			a.add("sink-pushes", "Count", float64(stats.Pushes-prev.Pushes), "sink", name)
+			a.add("sink-failures", "Count", float64(stats.Failures-prev.Failures), "sink", name)
+		}
+		a.add("dropped-rounds", "Count", float64(current.DroppedRounds-prevGroup.DroppedRounds))
+		a.add("dropped-datapoints", "Count", float64(current.DroppedDatapoints-prevGroup.DroppedDatapoints))
+		prevGroup = current
+
+		if first {
+			global := &selfMetricsAdder{metrics: a.metrics, global: true}
+			addProcessMetrics(global)
+			a.metrics = global.metrics
+		}
+		return a.metrics
+	}
+}
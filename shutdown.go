@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	cw "github.com/uovobw/uwsgi-metrics-poller/cloudwatch_pusher"
+	uwsgi "github.com/uovobw/uwsgi-metrics-poller/uwsgi_poller"
+	"golang.org/x/net/context"
+)
+
+const (
+	// EXIT_OK means every poll was drained and every sink flushed
+	EXIT_OK = 0
+	// EXIT_INCOMPLETE_SHUTDOWN means some polls were cancelled or some
+	// datapoints could not be flushed before the shutdown timeout
+	EXIT_INCOMPLETE_SHUTDOWN = 2
+	// EXIT_FORCED means a second signal cut the shutdown short
+	EXIT_FORCED = 130
+)
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received, then shuts
+// down and returns the exit code. a second signal exits immediately
+func waitForShutdown(stop context.CancelFunc, etcdDone, statsDone, eventsDone chan int) int {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	logger.Infof("received %s, shutting down within %s", sig, cfg.ShutdownTimeout)
+	go func() {
+		sig := <-sigs
+		logger.Warnf("received %s again, exiting now", sig)
+		os.Exit(EXIT_FORCED)
+	}()
+	return shutdown(stop, etcdDone, statsDone, eventsDone)
+}
+
+// shutdown stops the discovery, lets the running polls finish, pushes the
+// rounds not closed yet, including the current partial one, and flushes
+// every sink and the webhook, all within the shutdown timeout
+func shutdown(stop context.CancelFunc, etcdDone, statsDone, eventsDone chan int) int {
+	code := EXIT_OK
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// no host is added or removed from now on
+	stop()
+	<-etcdDone
+
+	err := uwsgiScheduler.Drain(ctx)
+	if err != nil {
+		logger.Errorf("polls still running were cancelled: %s", err)
+		code = EXIT_INCOMPLETE_SHUTDOWN
+	}
+	if err != uwsgi.ErrPollsRunning {
+		// the pollers are done, wait for their last stats to reach the
+		// pushers before closing the rounds and for their last events to
+		// reach the handlers before closing the webhook. polls left behind
+		// may still send, so then the channels are left open
+		close(uwsgiStatsChan)
+		<-statsDone
+		close(uwsgiEventsChan)
+		<-eventsDone
+	}
+	uwsgiScheduler.FlushRounds()
+
+	stateLock.Lock()
+	h := webhook
+	webhook = nil
+	stateLock.Unlock()
+	if h != nil {
+		err := h.Close(ctx)
+		if err != nil {
+			logger.Errorf("error flushing the webhook: %s", err)
+			code = EXIT_INCOMPLETE_SHUTDOWN
+		}
+	}
+
+	// the pushers are stopped without holding the lock, their last push
+	// reads the state for the self metrics
+	stateLock.RLock()
+	stopping := make(map[string]*cw.CloudWatchPusher, len(pushers))
+	for name, pusher := range pushers {
+		stopping[name] = pusher
+	}
+	stateLock.RUnlock()
+	for name, pusher := range stopping {
+		err := pusher.Stop(ctx)
+		if err != nil {
+			logger.Errorf("error flushing the pusher of group %s: %s", name, err)
+			code = EXIT_INCOMPLETE_SHUTDOWN
+		}
+	}
+	return code
+}
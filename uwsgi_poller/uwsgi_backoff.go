@@ -0,0 +1,56 @@
+package uwsgi_poller
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// health states of a polled host
+const (
+	HEALTH_UP = iota
+	HEALTH_DEGRADED
+	HEALTH_DOWN
+)
+
+func HealthName(health int) string {
+	names := map[int]string{
+		HEALTH_UP:       "up",
+		HEALTH_DEGRADED: "degraded",
+		HEALTH_DOWN:     "down",
+	}
+	name, _ := names[health]
+	return name
+}
+
+var (
+	jitterLock   sync.Mutex
+	jitterSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff computes exponentially growing delays. every delay is randomly
+// moved by up to Jitter times its value so that hosts failing together do
+// not keep being retried together
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// Delay returns the delay before the given retry, starting from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		jitterLock.Lock()
+		delay += delay * b.Jitter * (2*jitterSource.Float64() - 1)
+		jitterLock.Unlock()
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,126 @@
+package uwsgi_poller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	ERR_CONNECT = iota
+	ERR_TIMEOUT
+	ERR_TRUNCATED
+	ERR_TOO_LARGE
+	ERR_INVALID_JSON
+)
+
+// policies applied to a host whose responses cannot be parsed
+const (
+	PARSE_ERROR_SKIP = iota
+	PARSE_ERROR_BACKOFF
+	PARSE_ERROR_QUARANTINE
+)
+
+var parseErrorPolicies = map[string]int{
+	"skip":       PARSE_ERROR_SKIP,
+	"backoff":    PARSE_ERROR_BACKOFF,
+	"quarantine": PARSE_ERROR_QUARANTINE,
+}
+
+// ParseErrorPolicyNames lists the accepted names of the parse error policies
+var ParseErrorPolicyNames = []string{"skip", "backoff", "quarantine"}
+
+func ParseErrorPolicyFromString(name string) (int, error) {
+	policy, ok := parseErrorPolicies[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown parse error policy %s, must be one of %s", name, strings.Join(ParseErrorPolicyNames, ","))
+	}
+	return policy, nil
+}
+
+var errorKindNames = map[int]string{
+	ERR_CONNECT:      "connect",
+	ERR_TIMEOUT:      "timeout",
+	ERR_TRUNCATED:    "truncated",
+	ERR_TOO_LARGE:    "too-large",
+	ERR_INVALID_JSON: "invalid-json",
+}
+
+// ErrorKindName returns the short name of a kind of poll error
+func ErrorKindName(kind int) string {
+	name, ok := errorKindNames[kind]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+var errTooLarge = errors.New("payload exceeds the maximum size")
+
+// ErrPollsRunning is returned by Drain when some polls did not return even
+// after being cancelled, they may still send their stats and events
+var ErrPollsRunning = errors.New("polls still running after being cancelled")
+
+// PollError is returned when polling a host fails, Kind tells what went wrong
+type PollError struct {
+	Kind    int
+	Address string
+	Err     error
+}
+
+func (e *PollError) Error() string {
+	kinds := map[int]string{
+		ERR_CONNECT:      "connection error",
+		ERR_TIMEOUT:      "timeout",
+		ERR_TRUNCATED:    "truncated response",
+		ERR_TOO_LARGE:    "response too large",
+		ERR_INVALID_JSON: "invalid json",
+	}
+	kind, _ := kinds[e.Kind]
+	return fmt.Sprintf("%s polling %s: %s", kind, e.Address, e.Err)
+}
+
+// IsPollError reports whether err is a PollError of the given kind
+func IsPollError(err error, kind int) bool {
+	perr, ok := err.(*PollError)
+	return ok && perr.Kind == kind
+}
+
+// limitedReader fails with errTooLarge instead of returning EOF once more
+// than remaining bytes have been read, so that an oversized payload is not
+// mistaken for a truncated one
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(b []byte) (n int, err error) {
+	if l.remaining <= 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(b)) > l.remaining {
+		b = b[:l.remaining]
+	}
+	n, err = l.r.Read(b)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// cappedBuffer keeps at most max bytes of what is written to it and silently
+// drops the rest, it is used to capture the beginning of a bad payload
+type cappedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (c *cappedBuffer) Write(b []byte) (int, error) {
+	if room := c.max - len(c.buf); room > 0 {
+		if len(b) > room {
+			c.buf = append(c.buf, b[:room]...)
+		} else {
+			c.buf = append(c.buf, b...)
+		}
+	}
+	return len(b), nil
+}
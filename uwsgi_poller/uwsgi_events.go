@@ -0,0 +1,302 @@
+package uwsgi_poller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// EventReason tells why a UwsgiEvent was emitted
+type EventReason int
+
+const (
+	PARSE_ERROR EventReason = iota
+	HOST_UNREACHABLE
+	QUIT_RECEIVED
+	WORKER_HARAKIRI
+	WORKER_RESPAWNED
+	MASTER_RESTARTED
+	HOST_QUARANTINED
+	HOST_RECOVERED
+	HEALTH_CHANGED
+)
+
+var eventReasons = map[EventReason]string{
+	PARSE_ERROR:      "parse error",
+	HOST_UNREACHABLE: "host is unreachable",
+	QUIT_RECEIVED:    "quit signal received",
+	WORKER_HARAKIRI:  "worker harakiri",
+	WORKER_RESPAWNED: "worker respawned",
+	MASTER_RESTARTED: "master restarted",
+	HOST_QUARANTINED: "host quarantined",
+	HOST_RECOVERED:   "host recovered",
+	HEALTH_CHANGED:   "host health changed",
+}
+
+func (r EventReason) String() string {
+	msg, _ := eventReasons[r]
+	return msg
+}
+
+// Name returns a short identifier of the reason, fit for a metric dimension
+// or a configuration value
+func (r EventReason) Name() string {
+	return strings.Replace(r.String(), " ", "-", -1)
+}
+
+// EventReasonFromName is the inverse of EventReason.Name
+func EventReasonFromName(name string) (EventReason, error) {
+	for reason := range eventReasons {
+		if reason.Name() == name {
+			return reason, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event reason %s", name)
+}
+
+// UwsgiEvent is emitted by a poller whenever something worth knowing happens
+// to the host it polls. the fields that do not apply to a reason are left
+// zero
+type UwsgiEvent struct {
+	Reason  EventReason
+	Address string
+	// Generation is the one of the poller that emitted the event
+	Generation int64
+	Labels     map[string]string
+	Time       time.Time
+	// Err is the error that caused the event, if any
+	Err error
+	// Failures is the number of consecutive failed polls of the host
+	Failures int
+	WorkerID int
+	OldPid   int
+	NewPid   int
+	Count    int
+	Health   int
+}
+
+func (e *UwsgiEvent) String() string {
+	msg := e.Reason.String()
+	if e.Address == "" {
+		return msg
+	}
+	switch e.Reason {
+	case WORKER_HARAKIRI, WORKER_RESPAWNED:
+		msg = fmt.Sprintf("%s. host: %s worker: %d pid: %d -> %d count: %d", msg, e.Address, e.WorkerID, e.OldPid, e.NewPid, e.Count)
+	case MASTER_RESTARTED:
+		msg = fmt.Sprintf("%s. host: %s pid: %d -> %d", msg, e.Address, e.OldPid, e.NewPid)
+	case PARSE_ERROR, HOST_QUARANTINED:
+		msg = fmt.Sprintf("%s. host: %s parse errors: %d", msg, e.Address, e.Count)
+	case HOST_UNREACHABLE:
+		msg = fmt.Sprintf("%s. host: %s failures: %d", msg, e.Address, e.Failures)
+	case HEALTH_CHANGED:
+		msg = fmt.Sprintf("%s. host: %s health: %s failures: %d", msg, e.Address, HealthName(e.Health), e.Failures)
+	default:
+		msg = fmt.Sprintf("%s. host: %s", msg, e.Address)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s error: %s", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *UwsgiEvent) MarshalJSON() ([]byte, error) {
+	errMsg := ""
+	if e.Err != nil {
+		errMsg = e.Err.Error()
+	}
+	// the health is only meaningful for the events telling it changed
+	health := ""
+	if e.Reason == HEALTH_CHANGED {
+		health = HealthName(e.Health)
+	}
+	return json.Marshal(struct {
+		Reason   string            `json:"reason"`
+		Address  string            `json:"address"`
+		Labels   map[string]string `json:"labels,omitempty"`
+		Time     time.Time         `json:"time"`
+		Error    string            `json:"error,omitempty"`
+		Failures int               `json:"failures"`
+		WorkerID int               `json:"worker_id,omitempty"`
+		OldPid   int               `json:"old_pid,omitempty"`
+		NewPid   int               `json:"new_pid,omitempty"`
+		Count    int               `json:"count,omitempty"`
+		Health   string            `json:"health,omitempty"`
+	}{
+		Reason:   e.Reason.Name(),
+		Address:  e.Address,
+		Labels:   e.Labels,
+		Time:     e.Time,
+		Error:    errMsg,
+		Failures: e.Failures,
+		WorkerID: e.WorkerID,
+		OldPid:   e.OldPid,
+		NewPid:   e.NewPid,
+		Count:    e.Count,
+		Health:   health,
+	})
+}
+
+// EventHandler consumes the events emitted by the pollers
+type EventHandler interface {
+	HandleEvent(e *UwsgiEvent)
+}
+
+// EventHandlerFunc turns a function into an EventHandler
+type EventHandlerFunc func(e *UwsgiEvent)
+
+func (f EventHandlerFunc) HandleEvent(e *UwsgiEvent) {
+	f(e)
+}
+
+// LogHandler logs every event
+var LogHandler = EventHandlerFunc(func(e *UwsgiEvent) {
+	logger.With("host", e.Address).Infof("received event from uwsgi poller: %s", e)
+})
+
+// EventDispatcher hands every event to all the registered handlers, in
+// registration order
+type EventDispatcher struct {
+	sync.Mutex
+	handlers []EventHandler
+}
+
+func (d *EventDispatcher) Register(h EventHandler) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers = append(d.handlers, h)
+}
+
+func (d *EventDispatcher) Dispatch(e *UwsgiEvent) {
+	d.Lock()
+	handlers := d.handlers
+	d.Unlock()
+	for _, h := range handlers {
+		h.HandleEvent(e)
+	}
+}
+
+// Run dispatches the events received on the channel until it is closed
+func (d *EventDispatcher) Run(events <-chan *UwsgiEvent) {
+	for e := range events {
+		d.Dispatch(e)
+	}
+}
+
+const (
+	// webhookQueueSize is how many events can wait to be posted to a
+	// webhook, the ones coming while the queue is full are dropped
+	webhookQueueSize = 1000
+)
+
+// webhookDropped counts the events dropped by every webhook since the start
+var webhookDropped int64
+
+// WebhookDropped returns the number of events dropped since the start
+// because a webhook could not keep up with them
+func WebhookDropped() int64 {
+	return atomic.LoadInt64(&webhookDropped)
+}
+
+// WebhookHandler notifies an external service by posting events as JSON to
+// a URL. only the events with one of Reasons are posted, all of them if
+// Reasons is empty. the events are posted one at a time, in the order they
+// were emitted, by a single worker
+type WebhookHandler struct {
+	URL     string
+	Reasons map[EventReason]bool
+	client  *http.Client
+	queue   chan []byte
+	quit    chan int
+	done    chan int
+	closing sync.Once
+}
+
+func NewWebhookHandler(url string, reasons []EventReason, timeout time.Duration) *WebhookHandler {
+	w := &WebhookHandler{
+		URL:     url,
+		Reasons: make(map[EventReason]bool),
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan []byte, webhookQueueSize),
+		quit:    make(chan int),
+		done:    make(chan int),
+	}
+	for _, reason := range reasons {
+		w.Reasons[reason] = true
+	}
+	go w.run()
+	return w
+}
+
+// HandleEvent queues the event to be posted so that a slow endpoint does not
+// hold back the other handlers. when the queue is full the event is dropped
+func (w *WebhookHandler) HandleEvent(e *UwsgiEvent) {
+	if len(w.Reasons) > 0 && !w.Reasons[e.Reason] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("error encoding event %s: %s", e, err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		if atomic.AddInt64(&webhookDropped, 1)%100 == 1 {
+			logger.Warnf("webhook %s is falling behind, dropping event %s (%d dropped so far)", w.URL, e, WebhookDropped())
+		}
+	}
+}
+
+// Close stops the worker once it has posted the events already queued and
+// waits for it until the context is done, the events handled afterwards are
+// dropped. it can be called more than once
+func (w *WebhookHandler) Close(ctx context.Context) error {
+	w.closing.Do(func() {
+		close(w.quit)
+	})
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *WebhookHandler) run() {
+	defer close(w.done)
+	for {
+		select {
+		case body := <-w.queue:
+			w.post(body)
+		case <-w.quit:
+			for {
+				select {
+				case body := <-w.queue:
+					w.post(body)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *WebhookHandler) post(body []byte) {
+	resp, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warnf("error posting event to %s: %s", w.URL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warnf("error posting event to %s: status %s", w.URL, resp.Status)
+	}
+}
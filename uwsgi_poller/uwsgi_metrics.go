@@ -0,0 +1,185 @@
+package uwsgi_poller
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in milliseconds, of the buckets of
+// the latency histograms
+var LatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Histogram counts observations in buckets of fixed upper bounds, the last
+// bucket holding everything above the highest bound. it is safe to be used
+// from any number of goroutines
+type Histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i += 1
+	}
+	h.counts[i] += 1
+	h.count += 1
+	h.sum += v
+}
+
+// ObserveDuration records a duration in milliseconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(float64(d) / float64(time.Millisecond))
+}
+
+// HistogramSnapshot is the state of a histogram at a given time
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Count  int64     `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+	counts := make([]int64, len(h.counts))
+	copy(counts, h.counts)
+	return HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: counts,
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+// Sub returns the observations made since an earlier snapshot of the same
+// histogram
+func (s HistogramSnapshot) Sub(prev HistogramSnapshot) HistogramSnapshot {
+	d := HistogramSnapshot{
+		Bounds: s.Bounds,
+		Counts: make([]int64, len(s.Counts)),
+		Count:  s.Count - prev.Count,
+		Sum:    s.Sum - prev.Sum,
+	}
+	for i := range s.Counts {
+		d.Counts[i] = s.Counts[i]
+		if i < len(prev.Counts) {
+			d.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return d
+}
+
+func (s HistogramSnapshot) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the given quantile,
+// the highest bound if it falls in the last bucket
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := int64(q*float64(s.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range s.Counts {
+		seen += n
+		if seen >= rank && i < len(s.Bounds) {
+			return s.Bounds[i]
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// PollStats instruments the polls run by a scheduler. Lag is the delay
+// between the time a poll was due and the time it started
+type PollStats struct {
+	Latency *Histogram
+	Lag     *Histogram
+
+	sync.Mutex
+	polls       int64
+	errors      map[string]int64
+	parseErrors int64
+	latePolls   int64
+}
+
+func newPollStats() *PollStats {
+	return &PollStats{
+		Latency: NewHistogram(LatencyBuckets),
+		Lag:     NewHistogram(LatencyBuckets),
+		errors:  make(map[string]int64),
+	}
+}
+
+// recordLag records the delay a poll started with, late telling whether it
+// started later than its slot allows
+func (s *PollStats) recordLag(lag time.Duration, late bool) {
+	s.Lag.ObserveDuration(lag)
+	if !late {
+		return
+	}
+	s.Lock()
+	s.latePolls += 1
+	s.Unlock()
+}
+
+func (s *PollStats) record(took time.Duration, err error) {
+	s.Latency.ObserveDuration(took)
+	s.Lock()
+	defer s.Unlock()
+	s.polls += 1
+	if err == nil {
+		return
+	}
+	kind := "other"
+	if perr, ok := err.(*PollError); ok {
+		kind = ErrorKindName(perr.Kind)
+		if perr.Kind == ERR_INVALID_JSON || perr.Kind == ERR_TOO_LARGE {
+			s.parseErrors += 1
+		}
+	}
+	s.errors[kind] += 1
+}
+
+// PollCounts are the totals of a PollStats since the scheduler started
+type PollCounts struct {
+	Polls       int64            `json:"polls"`
+	Errors      map[string]int64 `json:"errors"`
+	ParseErrors int64            `json:"parse_errors"`
+	LatePolls   int64            `json:"late_polls"`
+}
+
+func (s *PollStats) Counts() PollCounts {
+	s.Lock()
+	defer s.Unlock()
+	errors := make(map[string]int64, len(s.errors))
+	for kind, n := range s.errors {
+		errors[kind] = n
+	}
+	return PollCounts{
+		Polls:       s.polls,
+		Errors:      errors,
+		ParseErrors: s.parseErrors,
+		LatePolls:   s.latePolls,
+	}
+}
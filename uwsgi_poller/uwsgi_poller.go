@@ -1,114 +1,409 @@
 package uwsgi_poller
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/uovobw/uwsgi-metrics-poller/logging"
+	"golang.org/x/net/context"
 )
 
-const (
-	PARSE_ERROR = iota
-	HOST_UNREACHABLE
-	QUIT_RECEIVED
+var logger = logging.New("uwsgi")
 
-	maxHostRetries = 5
+// generations numbers the pollers in creation order
+var generations int64
+
+const (
+	// payloadCaptureSize is how much of a payload that failed to parse is
+	// kept for debugging
+	payloadCaptureSize = 64 * 1024
 )
 
-type UwsgiEvent struct {
-	Reason int
+// Options tune how a single poll talks to the uwsgi stats server and how
+// the poller reacts to failures and to responses it cannot parse
+type Options struct {
+	DialTimeout    time.Duration
+	ReadTimeout    time.Duration
+	MaxPayloadSize int64
+	// FailureThreshold is the number of consecutive failed polls after which
+	// a host is considered down, Backoff spaces the probes of a down host
+	FailureThreshold int
+	Backoff          Backoff
+	ParseErrorPolicy int
+	MaxParseBackoff  time.Duration
+	QuarantinePeriod time.Duration
+	// BadPayloadDir, when set, is where the payloads that failed to parse
+	// are written
+	BadPayloadDir string
 }
 
-func makeUwsgiEvent(reason int) *UwsgiEvent {
+var DefaultOptions = Options{
+	DialTimeout:      5 * time.Second,
+	ReadTimeout:      10 * time.Second,
+	MaxPayloadSize:   4 * 1024 * 1024,
+	FailureThreshold: 5,
+	Backoff: Backoff{
+		Initial:    30 * time.Second,
+		Max:        10 * time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	},
+	ParseErrorPolicy: PARSE_ERROR_SKIP,
+	MaxParseBackoff:  10 * time.Minute,
+	QuarantinePeriod: 15 * time.Minute,
+}
+
+// newEvent creates an event about the polled host
+func (p *UwsgiPoller) newEvent(reason EventReason, err error) *UwsgiEvent {
 	return &UwsgiEvent{
-		Reason: reason,
+		Reason:     reason,
+		Address:    p.Target,
+		Generation: p.Generation,
+		Labels:     p.Labels,
+		Time:       time.Now(),
+		Err:        err,
+		Failures:   p.failures,
 	}
 }
 
-func (e *UwsgiEvent) String() string {
-	evts := map[int]string{
-		PARSE_ERROR:      "parse error",
-		HOST_UNREACHABLE: "host is unreachable",
-		QUIT_RECEIVED:    "quit signal received",
-	}
-	msg, _ := evts[e.Reason]
-	return msg
+func (p *UwsgiPoller) newWorkerEvent(reason EventReason, change *WorkerChange, count int) *UwsgiEvent {
+	e := p.newEvent(reason, nil)
+	e.WorkerID = change.WorkerID
+	e.OldPid = change.OldPid
+	e.NewPid = change.NewPid
+	e.Count = count
+	return e
 }
 
 type UwsgiPoller struct {
+	Target string
+	// Generation tells apart the pollers created over time for the same
+	// target, it is carried by their stats and events
+	Generation int64
+	Labels     map[string]string
 	Address    *net.TCPAddr
 	Period     time.Duration
+	Options    Options
 	StatsChan  chan<- *UwsgiStats
 	EventsChan chan<- *UwsgiEvent
-	quitChan   chan int
-	ticker     *time.Ticker
+	last       *UwsgiStats
+	log        *logging.Logger
+
+	failures               int
+	consecutiveParseErrors int
+
+	sync.Mutex
+	health         int
+	parseErrors    int
+	lastBadPayload []byte
+	lastPoll       time.Time
+	lastError      error
+	latest         *UwsgiStats
+}
+
+// PollerStatus is the state of a poller as seen from outside
+type PollerStatus struct {
+	Target      string
+	Labels      map[string]string
+	Health      int
+	LastPoll    time.Time
+	LastError   error
+	Failures    int
+	ParseErrors int
 }
 
-func New(addr string, period int, outdata chan<- *UwsgiStats, events chan<- *UwsgiEvent, quit chan int) (p *UwsgiPoller, err error) {
+func New(addr string, labels map[string]string, period time.Duration, opts Options, outdata chan<- *UwsgiStats, events chan<- *UwsgiEvent) (p *UwsgiPoller, err error) {
 	a, err := net.ResolveTCPAddr("tcp4", addr)
 	if err != nil {
 		return nil, err
 	}
-	pd := time.Duration(period) * time.Second
 	p = &UwsgiPoller{
+		Target:     addr,
+		Generation: atomic.AddInt64(&generations, 1),
+		Labels:     labels,
 		Address:    a,
-		Period:     pd,
+		Period:     period,
+		Options:    opts,
 		StatsChan:  outdata,
 		EventsChan: events,
-		quitChan:   quit,
-		ticker:     time.NewTicker(pd),
+		log:        logger.With("host", addr),
 	}
-	log.Printf("created poller for %s interval %d", addr, period)
+	p.log.Debugf("created poller with interval %s", period)
 	return p, nil
 }
 
-func (p *UwsgiPoller) getStats() (s *UwsgiStats, err error) {
-	conn, err := net.DialTCP("tcp4", nil, p.Address)
+// getStats polls the host once. the whole exchange is bound by the dial and
+// read timeouts and the response is decoded while it is read, never buffering
+// more than MaxPayloadSize bytes. every failure is returned as a *PollError.
+// cancelling the context aborts the exchange
+func (p *UwsgiPoller) getStats(ctx context.Context) (s *UwsgiStats, err error) {
+	dialer := &net.Dialer{Timeout: p.Options.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp4", p.Address.String())
 	if err != nil {
-		log.Printf("error reading from remote: %s", err)
-		return nil, err
+		p.log.Debugf("error reading from remote: %s", err)
+		return nil, p.pollError(err)
 	}
 	defer conn.Close()
-	var buf bytes.Buffer
-	io.Copy(&buf, conn)
+	done := make(chan int)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if p.Options.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.Options.ReadTimeout))
+	}
+	var r io.Reader = conn
+	if p.Options.MaxPayloadSize > 0 {
+		r = &limitedReader{r: conn, remaining: p.Options.MaxPayloadSize}
+	}
+	raw := &cappedBuffer{max: payloadCaptureSize}
 	s = &UwsgiStats{}
-	err = json.Unmarshal(buf.Bytes(), s)
+	err = json.NewDecoder(io.TeeReader(r, raw)).Decode(s)
 	if err != nil {
-		log.Printf("error loading stats, this will probably repeat in the future, quitting")
-		p.quitChan <- 1
-		return nil, fmt.Errorf("error loading uwsgi response: %s.", err)
+		perr := p.pollError(err)
+		if perr.Kind == ERR_INVALID_JSON || perr.Kind == ERR_TOO_LARGE {
+			p.captureBadPayload(raw.buf)
+		}
+		return nil, perr
 	}
 	return s, nil
 }
 
-func (p *UwsgiPoller) Run() {
-	log.Printf("poller for %s running", p.Address.String())
-	go func(poller *UwsgiPoller) {
-		unreachableCount := 0
-		for {
-			select {
-			case <-poller.ticker.C:
-				data, err := poller.getStats()
-				if err != nil {
-					log.Printf("error getting stats: %s. host might be down", err)
-					unreachableCount += 1
-					if unreachableCount == maxHostRetries {
-						poller.EventsChan <- makeUwsgiEvent(HOST_UNREACHABLE)
-						log.Printf("maximum number of retries reached (%d), goroutine for host %s quitting", unreachableCount, poller.Address.String())
-						return
-					}
-				} else {
-					unreachableCount = 0
-					poller.StatsChan <- data
-				}
-			case <-poller.quitChan:
-				poller.EventsChan <- makeUwsgiEvent(QUIT_RECEIVED)
-				log.Printf("poller for %s quitting", poller.Address.String())
-				return
-			}
+// captureBadPayload keeps the beginning of a payload that failed to parse
+// and, if configured, writes it to BadPayloadDir
+func (p *UwsgiPoller) captureBadPayload(payload []byte) {
+	p.Lock()
+	p.lastBadPayload = payload
+	p.Unlock()
+	if p.Options.BadPayloadDir == "" {
+		return
+	}
+	name := fmt.Sprintf("%s-%d.json", strings.Replace(p.Target, ":", "_", -1), time.Now().Unix())
+	path := filepath.Join(p.Options.BadPayloadDir, name)
+	err := ioutil.WriteFile(path, payload, os.FileMode(0644))
+	if err != nil {
+		p.log.Errorf("error saving bad payload: %s", err)
+		return
+	}
+	p.log.Infof("bad payload saved in %s", path)
+}
+
+// LastBadPayload returns the beginning of the last payload of this host
+// that failed to parse
+func (p *UwsgiPoller) LastBadPayload() []byte {
+	p.Lock()
+	defer p.Unlock()
+	return p.lastBadPayload
+}
+
+// pollError classifies an error met while polling
+func (p *UwsgiPoller) pollError(err error) *PollError {
+	perr := &PollError{
+		Kind:    ERR_CONNECT,
+		Address: p.Target,
+		Err:     err,
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		perr.Kind = ERR_TIMEOUT
+		return perr
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		perr.Kind = ERR_INVALID_JSON
+		return perr
+	case *net.OpError:
+		if e.Op == "dial" {
+			return perr
+		}
+		// the connection broke while reading
+		perr.Kind = ERR_TRUNCATED
+		return perr
+	}
+	switch err {
+	case errTooLarge:
+		perr.Kind = ERR_TOO_LARGE
+	case io.EOF, io.ErrUnexpectedEOF:
+		perr.Kind = ERR_TRUNCATED
+	}
+	return perr
+}
+
+// trackWorkers compares the new stats with the previous poll, records the
+// detected master restart and worker changes in the stats and emits an event
+// for each of them
+func (p *UwsgiPoller) trackWorkers(ctx context.Context, s *UwsgiStats) {
+	s.Target = p.Target
+	s.Labels = p.Labels
+	if p.last != nil && p.last.Pid != s.Pid {
+		s.MasterRestarted = true
+		p.log.Infof("uwsgi master restarted, pid %d -> %d identity %s -> %s", p.last.Pid, s.Pid, p.last.UniqueID(), s.UniqueID())
+		e := p.newEvent(MASTER_RESTARTED, nil)
+		e.OldPid = p.last.Pid
+		e.NewPid = s.Pid
+		p.emit(ctx, e)
+	}
+	s.Changes = DiffWorkers(p.last, s)
+	p.last = s
+	for _, change := range s.Changes {
+		if change.Harakiris > 0 {
+			p.log.Warnf("worker %d hit harakiri %d time(s)", change.WorkerID, change.Harakiris)
+			p.emit(ctx, p.newWorkerEvent(WORKER_HARAKIRI, change, change.Harakiris))
+		}
+		if change.Respawns > 0 {
+			p.emit(ctx, p.newWorkerEvent(WORKER_RESPAWNED, change, change.Respawns))
+		}
+	}
+}
+
+// handleParseError applies the parse error policy and returns how long to
+// wait before polling the host again. only this poller is affected, the
+// other hosts keep being polled
+func (p *UwsgiPoller) handleParseError(ctx context.Context, err error) time.Duration {
+	p.Lock()
+	p.parseErrors += 1
+	count := p.parseErrors
+	p.Unlock()
+	p.consecutiveParseErrors += 1
+	p.log.Warnf("error parsing stats (%d so far): %s", count, err)
+	e := p.newEvent(PARSE_ERROR, err)
+	e.Count = count
+	p.emit(ctx, e)
+	switch p.Options.ParseErrorPolicy {
+	case PARSE_ERROR_BACKOFF:
+		backoff := Backoff{
+			Initial:    p.Period,
+			Max:        p.Options.MaxParseBackoff,
+			Multiplier: 2,
+			Jitter:     p.Options.Backoff.Jitter,
 		}
-	}(p)
+		delay := backoff.Delay(p.consecutiveParseErrors - 1)
+		p.log.Infof("backing off polling for %s", delay)
+		return delay
+	case PARSE_ERROR_QUARANTINE:
+		p.log.Warnf("quarantining for %s", p.Options.QuarantinePeriod)
+		e := p.newEvent(HOST_QUARANTINED, err)
+		e.Count = count
+		p.emit(ctx, e)
+		return p.Options.QuarantinePeriod
+	}
+	return p.Period
+}
+
+// Status returns the current state of the poller
+func (p *UwsgiPoller) Status() PollerStatus {
+	p.Lock()
+	defer p.Unlock()
+	return PollerStatus{
+		Target:      p.Target,
+		Labels:      p.Labels,
+		Health:      p.health,
+		LastPoll:    p.lastPoll,
+		LastError:   p.lastError,
+		Failures:    p.failures,
+		ParseErrors: p.parseErrors,
+	}
+}
+
+// LastStats returns the stats of the last successful poll, nil if there was
+// none yet
+func (p *UwsgiPoller) LastStats() *UwsgiStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.latest
+}
+
+// setHealth records the health of the host and emits the matching events
+// if it changed, err is the error of the last poll if it failed
+func (p *UwsgiPoller) setHealth(ctx context.Context, health int, err error) {
+	p.Lock()
+	old := p.health
+	p.health = health
+	p.Unlock()
+	if old == health {
+		return
+	}
+	p.log.Infof("host is now %s", HealthName(health))
+	e := p.newEvent(HEALTH_CHANGED, err)
+	e.Health = health
+	p.emit(ctx, e)
+	switch {
+	case health == HEALTH_DOWN:
+		p.emit(ctx, p.newEvent(HOST_UNREACHABLE, err))
+	case old == HEALTH_DOWN:
+		p.emit(ctx, p.newEvent(HOST_RECOVERED, nil))
+	}
+}
+
+// handleFailure works as a circuit breaker: the first failures only mark
+// the host as degraded and it keeps being polled at the normal period, once
+// FailureThreshold is reached the host is down and it is only probed again
+// after an exponentially growing delay. a successful probe closes the
+// circuit, a failed one makes the next delay longer
+func (p *UwsgiPoller) handleFailure(ctx context.Context, err error) time.Duration {
+	p.Lock()
+	p.failures += 1
+	p.Unlock()
+	if p.failures < p.Options.FailureThreshold {
+		p.log.Warnf("error getting stats: %s. host might be down", err)
+		p.setHealth(ctx, HEALTH_DEGRADED, err)
+		return p.Period
+	}
+	p.setHealth(ctx, HEALTH_DOWN, err)
+	delay := p.Options.Backoff.Delay(p.failures - p.Options.FailureThreshold)
+	p.log.Errorf("error getting stats: %s. host is down after %d failures, probing again in %s", err, p.failures, delay)
+	return delay
+}
+
+// poll polls the host once on behalf of the given collection round and
+// returns how long to wait before the next poll, reported is set when stats
+// were sent for the round. err is the error of the poll if it failed
+func (p *UwsgiPoller) poll(ctx context.Context, round int64) (next time.Duration, reported bool, err error) {
+	data, err := p.getStats(ctx)
+	p.Lock()
+	p.lastPoll = time.Now()
+	p.lastError = err
+	p.Unlock()
+	if err != nil {
+		if IsPollError(err, ERR_INVALID_JSON) || IsPollError(err, ERR_TOO_LARGE) {
+			return p.handleParseError(ctx, err), false, err
+		}
+		return p.handleFailure(ctx, err), false, err
+	}
+	p.setHealth(ctx, HEALTH_UP, nil)
+	p.consecutiveParseErrors = 0
+	p.trackWorkers(ctx, data)
+	data.Round = round
+	data.Generation = p.Generation
+	p.Lock()
+	p.failures = 0
+	p.latest = data
+	p.Unlock()
+	select {
+	case p.StatsChan <- data:
+	case <-ctx.Done():
+		return p.Period, false, ctx.Err()
+	}
+	return p.Period, true, nil
+}
+
+// emit sends an event unless the poll is cancelled, on shutdown nothing may
+// be reading the events anymore
+func (p *UwsgiPoller) emit(ctx context.Context, e *UwsgiEvent) {
+	select {
+	case p.EventsChan <- e:
+	case <-ctx.Done():
+	}
 }
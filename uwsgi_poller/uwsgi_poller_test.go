@@ -0,0 +1,299 @@
+package uwsgi_poller
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const testPayload = `{"pid": 100, "version": "2.0.18", "workers": [{"id": 1, "pid": 101, "status": "idle"}]}`
+
+// statsServer is a local uwsgi stats server answering every connection
+// with the next of the responses queued
+type statsServer struct {
+	listener  net.Listener
+	responses chan func(conn net.Conn)
+}
+
+func newStatsServer(t *testing.T) *statsServer {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &statsServer{
+		listener:  l,
+		responses: make(chan func(conn net.Conn), 100),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			respond := <-s.responses
+			go func() {
+				defer conn.Close()
+				respond(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *statsServer) close() {
+	s.listener.Close()
+}
+
+// serve queues a response writing the payload
+func (s *statsServer) serve(payload string) {
+	s.responses <- func(conn net.Conn) {
+		conn.Write([]byte(payload))
+	}
+}
+
+// drop queues a response closing the connection without writing anything
+func (s *statsServer) drop() {
+	s.responses <- func(conn net.Conn) {}
+}
+
+// hang queues a response writing nothing for a while
+func (s *statsServer) hang(d time.Duration) {
+	s.responses <- func(conn net.Conn) {
+		time.Sleep(d)
+	}
+}
+
+func testOptions() Options {
+	opts := DefaultOptions
+	opts.DialTimeout = time.Second
+	opts.ReadTimeout = time.Second
+	opts.MaxPayloadSize = 1024
+	opts.Backoff.Jitter = 0
+	return opts
+}
+
+func newTestPoller(t *testing.T, addr string, opts Options) (*UwsgiPoller, chan *UwsgiStats, chan *UwsgiEvent) {
+	stats := make(chan *UwsgiStats, 100)
+	events := make(chan *UwsgiEvent, 100)
+	p, err := New(addr, map[string]string{"etcd_dir": "/test"}, time.Minute, opts, stats, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, stats, events
+}
+
+func TestGetStatsErrors(t *testing.T) {
+	s := newStatsServer(t)
+	defer s.close()
+	opts := testOptions()
+	opts.ReadTimeout = 100 * time.Millisecond
+	p, _, _ := newTestPoller(t, s.listener.Addr().String(), opts)
+
+	tests := []struct {
+		name    string
+		respond func()
+		kind    int
+	}{
+		{"oversized", func() { s.serve(`{"cwd": "` + strings.Repeat("x", 2048) + `"}`) }, ERR_TOO_LARGE},
+		{"truncated", func() { s.serve(testPayload[:40]) }, ERR_TRUNCATED},
+		{"dropped", func() { s.drop() }, ERR_TRUNCATED},
+		{"invalid", func() { s.serve(`{"pid": "not a number"}`) }, ERR_INVALID_JSON},
+		{"garbage", func() { s.serve("uwsgi says hello") }, ERR_INVALID_JSON},
+		{"silent", func() { s.hang(time.Second) }, ERR_TIMEOUT},
+	}
+	for _, test := range tests {
+		test.respond()
+		_, err := p.getStats(context.Background())
+		if !IsPollError(err, test.kind) {
+			t.Fatalf("%s: expected a %s error, got %v", test.name, ErrorKindName(test.kind), err)
+		}
+	}
+
+	s.serve(testPayload)
+	stats, err := p.getStats(context.Background())
+	if err != nil {
+		t.Fatalf("expected a valid payload to be read, got %s", err)
+	}
+	if stats.Pid != 100 || len(stats.Workers) != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestGetStatsKeepsBadPayload(t *testing.T) {
+	s := newStatsServer(t)
+	defer s.close()
+	p, _, _ := newTestPoller(t, s.listener.Addr().String(), testOptions())
+	s.serve(`{"pid": "not a number"}`)
+	p.getStats(context.Background())
+	if string(p.LastBadPayload()) != `{"pid": "not a number"}` {
+		t.Fatalf("expected the bad payload to be kept, got %q", p.LastBadPayload())
+	}
+}
+
+func TestGetStatsConnectError(t *testing.T) {
+	s := newStatsServer(t)
+	addr := s.listener.Addr().String()
+	s.close()
+	p, _, _ := newTestPoller(t, addr, testOptions())
+	_, err := p.getStats(context.Background())
+	if !IsPollError(err, ERR_CONNECT) {
+		t.Fatalf("expected a connect error, got %v", err)
+	}
+}
+
+func TestGetStatsCancelled(t *testing.T) {
+	s := newStatsServer(t)
+	defer s.close()
+	p, _, _ := newTestPoller(t, s.listener.Addr().String(), testOptions())
+	s.hang(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.getStats(ctx)
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the poll to be aborted when cancelled, got %v after %s", err, time.Since(start))
+	}
+}
+
+// reasons returns the reasons of the events emitted so far
+func reasons(events chan *UwsgiEvent) []EventReason {
+	got := make([]EventReason, 0)
+	for {
+		select {
+		case e := <-events:
+			got = append(got, e.Reason)
+		default:
+			return got
+		}
+	}
+}
+
+func TestParseErrorPolicies(t *testing.T) {
+	s := newStatsServer(t)
+	defer s.close()
+	tests := []struct {
+		policy  int
+		delays  []time.Duration
+		reasons []EventReason
+	}{
+		{PARSE_ERROR_SKIP, []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute}, []EventReason{PARSE_ERROR}},
+		{PARSE_ERROR_BACKOFF, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute}, []EventReason{PARSE_ERROR}},
+		{PARSE_ERROR_QUARANTINE, []time.Duration{time.Hour, time.Hour, time.Hour, time.Hour}, []EventReason{PARSE_ERROR, HOST_QUARANTINED}},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.ParseErrorPolicy = test.policy
+		opts.MaxParseBackoff = 5 * time.Minute
+		opts.QuarantinePeriod = time.Hour
+		p, stats, events := newTestPoller(t, s.listener.Addr().String(), opts)
+		for i, want := range test.delays {
+			s.serve(`{"pid": "not a number"}`)
+			next, reported, err := p.poll(context.Background(), 1)
+			if !IsPollError(err, ERR_INVALID_JSON) || reported {
+				t.Fatalf("policy %d: expected a parse error, got %v", test.policy, err)
+			}
+			if next != want {
+				t.Fatalf("policy %d: expected parse error %d to wait %s, got %s", test.policy, i+1, want, next)
+			}
+			if got := reasons(events); !reflect.DeepEqual(got, test.reasons) {
+				t.Fatalf("policy %d: expected events %v, got %v", test.policy, test.reasons, got)
+			}
+		}
+		if status := p.Status(); status.ParseErrors != len(test.delays) || status.Health != HEALTH_UP || status.Failures != 0 {
+			t.Fatalf("policy %d: expected only the parse errors to be counted, got %+v", test.policy, status)
+		}
+
+		// the poller keeps polling and a good payload starts over
+		s.serve(testPayload)
+		next, reported, err := p.poll(context.Background(), 2)
+		if err != nil || !reported || next != time.Minute {
+			t.Fatalf("policy %d: expected the host to be polled again, got %s %v %v", test.policy, next, reported, err)
+		}
+		if data := <-stats; data.Round != 2 {
+			t.Fatalf("policy %d: expected the stats of round 2, got %d", test.policy, data.Round)
+		}
+		s.serve(`{"pid": "not a number"}`)
+		next, _, _ = p.poll(context.Background(), 3)
+		if next != test.delays[0] {
+			t.Fatalf("policy %d: expected the delays to start over after a good poll, got %s", test.policy, next)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := newStatsServer(t)
+	defer s.close()
+	opts := testOptions()
+	opts.FailureThreshold = 3
+	opts.Backoff = Backoff{Initial: 30 * time.Second, Max: 2 * time.Minute, Multiplier: 2}
+	p, _, events := newTestPoller(t, s.listener.Addr().String(), opts)
+
+	steps := []struct {
+		health  int
+		next    time.Duration
+		reasons []EventReason
+	}{
+		{HEALTH_DEGRADED, time.Minute, []EventReason{HEALTH_CHANGED}},
+		{HEALTH_DEGRADED, time.Minute, []EventReason{}},
+		{HEALTH_DOWN, 30 * time.Second, []EventReason{HEALTH_CHANGED, HOST_UNREACHABLE}},
+		{HEALTH_DOWN, time.Minute, []EventReason{}},
+		{HEALTH_DOWN, 2 * time.Minute, []EventReason{}},
+		{HEALTH_DOWN, 2 * time.Minute, []EventReason{}},
+	}
+	for i, step := range steps {
+		s.drop()
+		next, reported, err := p.poll(context.Background(), int64(i))
+		if !IsPollError(err, ERR_TRUNCATED) || reported {
+			t.Fatalf("failure %d: expected a truncated response, got %v", i+1, err)
+		}
+		if health := p.Status().Health; health != step.health {
+			t.Fatalf("failure %d: expected the host to be %s, got %s", i+1, HealthName(step.health), HealthName(health))
+		}
+		if next != step.next {
+			t.Fatalf("failure %d: expected to wait %s, got %s", i+1, step.next, next)
+		}
+		if got := reasons(events); !reflect.DeepEqual(got, step.reasons) {
+			t.Fatalf("failure %d: expected events %v, got %v", i+1, step.reasons, got)
+		}
+	}
+
+	s.serve(testPayload)
+	next, reported, err := p.poll(context.Background(), 10)
+	if err != nil || !reported || next != time.Minute {
+		t.Fatalf("expected a successful probe, got %s %v %v", next, reported, err)
+	}
+	if status := p.Status(); status.Health != HEALTH_UP || status.Failures != 0 {
+		t.Fatalf("expected the host to recover, got %+v", status)
+	}
+	if got := reasons(events); !reflect.DeepEqual(got, []EventReason{HEALTH_CHANGED, HOST_RECOVERED}) {
+		t.Fatalf("expected the recovery events, got %v", got)
+	}
+
+	// the circuit is closed again, a single failure only degrades the host
+	s.drop()
+	next, _, _ = p.poll(context.Background(), 11)
+	if health := p.Status().Health; health != HEALTH_DEGRADED || next != time.Minute {
+		t.Fatalf("expected a degraded host polled at its period, got %s after %s", HealthName(health), next)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, delay := range want {
+		if got := b.Delay(attempt); got != delay {
+			t.Fatalf("attempt %d: expected %s, got %s", attempt, delay, got)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := b.Delay(2)
+		if got < 2*time.Second || got > 6*time.Second {
+			t.Fatalf("expected the jitter to keep the delay within half of 4s, got %s", got)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package uwsgi_poller
+
+import (
+	"fmt"
+	"time"
+)
+
+// Round is a collection round: one polling period during which every host
+// is polled once. it is closed some grace time after its end, when the polls
+// still running for it had a chance to complete
+type Round struct {
+	ID    int64
+	Start time.Time
+	End   time.Time
+	// Expected is the number of hosts that should have been polled in the
+	// round, Polled the number of them that were polled successfully
+	Expected int
+	Polled   int
+	// expected and polled hold the labels of those hosts by target, so that
+	// the round can be narrowed to some of them
+	expected map[string]map[string]string
+	polled   map[string]map[string]string
+}
+
+func newRound(id int64, period time.Duration) *Round {
+	start := roundStart(id, period)
+	return &Round{
+		ID:       id,
+		Start:    start,
+		End:      start.Add(period),
+		expected: make(map[string]map[string]string),
+		polled:   make(map[string]map[string]string),
+	}
+}
+
+func (r *Round) copy() *Round {
+	c := *r
+	c.expected = make(map[string]map[string]string, len(r.expected))
+	for target, labels := range r.expected {
+		c.expected[target] = labels
+	}
+	c.polled = make(map[string]map[string]string, len(r.polled))
+	for target, labels := range r.polled {
+		c.polled[target] = labels
+	}
+	return &c
+}
+
+// Select returns the round as seen by the hosts whose labels match, e.g.
+// the hosts of a single aggregation group
+func (r *Round) Select(match func(labels map[string]string) bool) *Round {
+	s := newRound(r.ID, r.End.Sub(r.Start))
+	for target, labels := range r.expected {
+		if match(labels) {
+			s.expected[target] = labels
+		}
+	}
+	for target, labels := range r.polled {
+		if match(labels) {
+			s.polled[target] = labels
+		}
+	}
+	s.Expected = len(s.expected)
+	s.Polled = len(s.polled)
+	return s
+}
+
+func (r *Round) String() string {
+	return fmt.Sprintf("round %d (%s) polled %d/%d hosts", r.ID, r.Start.Format(time.RFC3339), r.Polled, r.Expected)
+}
+
+// Coverage returns the fraction of the expected hosts that were polled, a
+// round where no host was expected is complete
+func (r *Round) Coverage() float64 {
+	if r.Expected == 0 {
+		return 1.0
+	}
+	coverage := float64(r.Polled) / float64(r.Expected)
+	if coverage > 1.0 {
+		coverage = 1.0
+	}
+	return coverage
+}
+
+// roundID returns the round a time falls in, rounds are aligned on multiples
+// of the period since the epoch
+func roundID(t time.Time, period time.Duration) int64 {
+	return t.UnixNano() / int64(period)
+}
+
+func roundStart(id int64, period time.Duration) time.Time {
+	return time.Unix(0, id*int64(period))
+}
@@ -0,0 +1,36 @@
+package uwsgi_poller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundSelectGroups(t *testing.T) {
+	r := newRound(1, time.Minute)
+	web := map[string]string{"etcd_dir": "/web"}
+	api := map[string]string{"etcd_dir": "/api"}
+	r.expected["10.0.0.1:1717"] = web
+	r.expected["10.0.0.2:1717"] = web
+	r.expected["10.0.0.3:1717"] = api
+	r.polled["10.0.0.1:1717"] = web
+	r.polled["10.0.0.3:1717"] = api
+	r.Expected, r.Polled = 3, 2
+
+	group := func(dir string) func(labels map[string]string) bool {
+		return func(labels map[string]string) bool { return labels["etcd_dir"] == dir }
+	}
+	w := r.Select(group("/web"))
+	if w.Expected != 2 || w.Polled != 1 || w.Coverage() != 0.5 {
+		t.Fatalf("expected the group missing a host to be half covered, got %s", w)
+	}
+	a := r.Select(group("/api"))
+	if a.Expected != 1 || a.Polled != 1 || a.Coverage() != 1.0 {
+		t.Fatalf("expected the other group to be complete, got %s", a)
+	}
+	if w.ID != r.ID || !w.Start.Equal(r.Start) || !w.End.Equal(r.End) {
+		t.Fatalf("expected the selected round to keep its times, got %s", w)
+	}
+	if r.Expected != 3 || r.Polled != 2 {
+		t.Fatalf("expected the round to be left untouched, got %s", r)
+	}
+}
@@ -0,0 +1,499 @@
+package uwsgi_poller
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// schedulerIdleWait is how long the scheduler sleeps when there is
+	// nothing to poll, it is woken up earlier when a poller is added
+	schedulerIdleWait = time.Hour
+	// drainCancelWait is how long Drain still waits for the polls it
+	// cancelled to return
+	drainCancelWait = time.Second
+	// lateTolerance is how long after its slot, jitter included, a poll can
+	// start before it counts as late
+	lateTolerance = time.Second
+)
+
+// Scheduler polls all the registered pollers from a pool of at most
+// MaxConcurrency concurrent polls, in collection rounds of one Period each.
+// every host gets a fixed offset within the round, derived from its address,
+// so that polls are spread across the round instead of bunching up at the
+// time hosts were discovered, and every poll is further moved by up to
+// Jitter without leaving its round. a round is closed RoundGrace after its
+// end and handed to the registered round handlers
+type Scheduler struct {
+	Period         time.Duration
+	MaxConcurrency int
+	Jitter         time.Duration
+	RoundGrace     time.Duration
+	// Stats instruments the polls
+	Stats *PollStats
+
+	sync.Mutex
+	entries       map[string]*scheduleEntry
+	queue         scheduleQueue
+	rounds        map[int64]*Round
+	lastClosed    int64
+	roundHandlers []func(r *Round)
+	wake          chan struct{}
+	quit          chan int
+	stopped       bool
+	// nextRound is the next round to be closed, roundsPolled counts the
+	// closed rounds in which at least a host was polled
+	nextRound    int64
+	roundsClosed int
+	roundsPolled int
+	// running tracks the polls in flight and the closing of the rounds,
+	// the polls are cancelled through pollCtx when they cannot finish in
+	// time on shutdown
+	running     sync.WaitGroup
+	pollCtx     context.Context
+	cancelPolls context.CancelFunc
+}
+
+type scheduleEntry struct {
+	poller     *UwsgiPoller
+	offset     time.Duration
+	due        time.Time
+	round      int64
+	firstRound int64
+	index      int
+	running    bool
+	removed    bool
+}
+
+// scheduleQueue is a heap of entries ordered by due time
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+func NewScheduler(period time.Duration, maxConcurrency int, jitter, roundGrace time.Duration) *Scheduler {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	pollCtx, cancelPolls := context.WithCancel(context.Background())
+	return &Scheduler{
+		Period:         period,
+		MaxConcurrency: maxConcurrency,
+		Jitter:         jitter,
+		RoundGrace:     roundGrace,
+		entries:        make(map[string]*scheduleEntry),
+		rounds:         make(map[int64]*Round),
+		wake:           make(chan struct{}, 1),
+		quit:           make(chan int),
+		pollCtx:        pollCtx,
+		cancelPolls:    cancelPolls,
+		Stats:          newPollStats(),
+		// the first round to close is the oldest one whose deadline has
+		// not passed yet
+		nextRound: roundID(time.Now().Add(-period-roundGrace), period) + 1,
+	}
+}
+
+// hostOffset returns the fixed position of a host within its period
+func hostOffset(target string, period time.Duration) time.Duration {
+	if period <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	return time.Duration(h.Sum64() % uint64(period))
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration((2*jitterSource.Float64() - 1) * float64(s.Jitter))
+}
+
+// nextSlot sets the entry due time to the first time after now matching
+// the host offset in a round not before minRound, shifted by the jitter but
+// kept within the same round
+func (s *Scheduler) nextSlot(e *scheduleEntry, now time.Time, minRound int64) {
+	id := roundID(now, s.Period)
+	if id < minRound {
+		id = minRound
+	}
+	start := roundStart(id, s.Period)
+	slot := start.Add(e.offset)
+	if !slot.After(now) {
+		start = start.Add(s.Period)
+		slot = slot.Add(s.Period)
+	}
+	due := slot.Add(s.jitter())
+	if due.Before(start) {
+		due = start
+	}
+	if end := start.Add(s.Period); !due.Before(end) {
+		due = end.Add(-time.Millisecond)
+	}
+	e.due = due
+	e.round = roundID(start, s.Period)
+}
+
+// OnRoundClose registers a function called with every closed round
+func (s *Scheduler) OnRoundClose(f func(r *Round)) {
+	s.Lock()
+	defer s.Unlock()
+	s.roundHandlers = append(s.roundHandlers, f)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add starts polling a host
+func (s *Scheduler) Add(p *UwsgiPoller) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[p.Target]; ok {
+		return
+	}
+	e := &scheduleEntry{
+		poller: p,
+		offset: hostOffset(p.Target, s.Period),
+	}
+	s.nextSlot(e, time.Now(), 0)
+	e.firstRound = e.round
+	s.entries[p.Target] = e
+	heap.Push(&s.queue, e)
+	p.log.Debugf("scheduled poller, first poll at %s", e.due.Format(time.RFC3339))
+	s.notify()
+}
+
+// Remove stops polling a host. a poll already running is let finish but the
+// host is not polled again
+func (s *Scheduler) Remove(target string) {
+	s.Lock()
+	e, ok := s.entries[target]
+	if ok {
+		delete(s.entries, target)
+		e.removed = true
+		if !e.running {
+			heap.Remove(&s.queue, e.index)
+		}
+	}
+	s.Unlock()
+	if ok {
+		e.poller.EventsChan <- e.poller.newEvent(QUIT_RECEIVED, nil)
+		e.poller.log.Infof("poller quitting")
+	}
+}
+
+// PollNow makes a host be polled right away, out of its slot, on behalf of
+// the current round. it is then polled again at its slot of the next round.
+// it returns false if the host is unknown or already being polled
+func (s *Scheduler) PollNow(target string) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[target]
+	if !ok || e.running {
+		return false
+	}
+	e.due = time.Now()
+	e.round = roundID(e.due, s.Period)
+	heap.Fix(&s.queue, e.index)
+	s.notify()
+	return true
+}
+
+// Pollers returns the pollers currently scheduled
+func (s *Scheduler) Pollers() []*UwsgiPoller {
+	s.Lock()
+	defer s.Unlock()
+	pollers := make([]*UwsgiPoller, 0, len(s.entries))
+	for _, e := range s.entries {
+		pollers = append(pollers, e.poller)
+	}
+	return pollers
+}
+
+func (s *Scheduler) recordLag(e *scheduleEntry, now time.Time) {
+	lag := now.Sub(e.due)
+	if lag < 0 {
+		lag = 0
+	}
+	// the due time already includes the jitter, polls starting well after it
+	// mean the pool cannot keep up with the number of hosts
+	late := lag > lateTolerance
+	s.Stats.recordLag(lag, late)
+	if late {
+		e.poller.log.Warnf("poll started %s late, consider raising the maximum concurrency", lag)
+	}
+}
+
+// reschedule records the outcome of a poll and queues the next poll of the
+// host. a host polled at its normal period keeps its slot, a host backing
+// off is polled after the delay it asked for, in whatever round that falls
+func (s *Scheduler) reschedule(e *scheduleEntry, round int64, next time.Duration, reported bool) {
+	s.Lock()
+	defer s.Unlock()
+	// a poll finishing after its round was closed is too late to count
+	if reported && round > s.lastClosed {
+		r := s.round(round)
+		r.polled[e.poller.Target] = e.poller.Labels
+		r.Polled = len(r.polled)
+	}
+	e.running = false
+	if e.removed {
+		return
+	}
+	now := time.Now()
+	if next == e.poller.Period {
+		// a negative jitter may have run the poll before its slot, make
+		// sure the host is not polled twice in the same round
+		s.nextSlot(e, now, e.round+1)
+	} else {
+		e.due = now.Add(next)
+		e.round = roundID(e.due, s.Period)
+	}
+	heap.Push(&s.queue, e)
+	s.notify()
+}
+
+// round returns the bookkeeping of a round, creating it if needed
+func (s *Scheduler) round(id int64) *Round {
+	r, ok := s.rounds[id]
+	if !ok {
+		r = newRound(id, s.Period)
+		s.rounds[id] = r
+	}
+	return r
+}
+
+// closeRound counts the hosts expected in a round, which are all the ones
+// scheduled since the round or before it, and hands it to the handlers. a
+// round cut short at the given time only expects the hosts whose slot had
+// already come by then
+func (s *Scheduler) closeRound(id int64, cut time.Time) {
+	s.Lock()
+	r := s.round(id)
+	delete(s.rounds, id)
+	s.lastClosed = id
+	s.nextRound = id + 1
+	s.roundsClosed += 1
+	s.expect(r, cut)
+	if r.Polled > 0 {
+		s.roundsPolled += 1
+	}
+	handlers := s.roundHandlers
+	s.Unlock()
+	if !cut.IsZero() && r.Polled == 0 {
+		// nothing was collected in the part of the round that went by
+		return
+	}
+	if r.Coverage() < 1.0 {
+		logger.Infof("closed incomplete %s", r)
+	}
+	for _, f := range handlers {
+		f(r)
+	}
+}
+
+// expect records the hosts expected in a round, see closeRound
+func (s *Scheduler) expect(r *Round, cut time.Time) {
+	r.expected = make(map[string]map[string]string, len(s.entries))
+	for _, e := range s.entries {
+		if e.firstRound > r.ID {
+			continue
+		}
+		if !cut.IsZero() && e.round <= r.ID && !e.due.Before(cut) {
+			continue
+		}
+		r.expected[e.poller.Target] = e.poller.Labels
+	}
+	r.Expected = len(r.expected)
+}
+
+// RoundsClosed returns the number of rounds closed since the scheduler
+// started
+func (s *Scheduler) RoundsClosed() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.roundsClosed
+}
+
+// RoundsPolled returns the number of rounds closed since the scheduler
+// started in which at least a host was polled
+func (s *Scheduler) RoundsPolled() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.roundsPolled
+}
+
+// PendingRound returns a copy of the next round to be closed as it stands,
+// with every host scheduled since it expected
+func (s *Scheduler) PendingRound() *Round {
+	s.Lock()
+	defer s.Unlock()
+	r := s.round(s.nextRound).copy()
+	s.expect(r, time.Time{})
+	return r
+}
+
+// runRounds closes every round RoundGrace after its end
+func (s *Scheduler) runRounds() {
+	defer s.running.Done()
+	for {
+		s.Lock()
+		id := s.nextRound
+		s.Unlock()
+		deadline := roundStart(id, s.Period).Add(s.Period + s.RoundGrace)
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		select {
+		case <-timer.C:
+			s.closeRound(id, time.Time{})
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Run dispatches the polls as they become due and closes the rounds until
+// Stop is called
+func (s *Scheduler) Run() {
+	s.Lock()
+	if s.stopped {
+		s.Unlock()
+		return
+	}
+	s.running.Add(1)
+	s.Unlock()
+	go s.runRounds()
+	slots := make(chan struct{}, s.MaxConcurrency)
+	for {
+		s.Lock()
+		wait := schedulerIdleWait
+		if len(s.queue) > 0 {
+			wait = s.queue[0].due.Sub(time.Now())
+		}
+		s.Unlock()
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				timer.Stop()
+				continue
+			case <-s.quit:
+				timer.Stop()
+				return
+			}
+		}
+		// wait for a free slot before taking the entry, so that the time
+		// spent waiting for the pool shows up as lag
+		select {
+		case slots <- struct{}{}:
+		case <-s.quit:
+			return
+		}
+		now := time.Now()
+		s.Lock()
+		if s.stopped {
+			s.Unlock()
+			return
+		}
+		if len(s.queue) == 0 || s.queue[0].due.After(now) {
+			s.Unlock()
+			<-slots
+			continue
+		}
+		e := heap.Pop(&s.queue).(*scheduleEntry)
+		e.running = true
+		s.recordLag(e, now)
+		s.running.Add(1)
+		s.Unlock()
+		go func(e *scheduleEntry, round int64) {
+			defer s.running.Done()
+			start := time.Now()
+			next, reported, err := e.poller.poll(s.pollCtx, round)
+			s.Stats.record(time.Since(start), err)
+			<-slots
+			s.reschedule(e, round, next, reported)
+		}(e, e.round)
+	}
+}
+
+// Stop makes Run return, running polls are not waited for
+func (s *Scheduler) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+	}
+}
+
+// Drain stops dispatching polls and waits for the ones running to finish.
+// the polls still running when the context is done are cancelled and an
+// error is returned. the polls that do not return even then are left behind
+// and ErrPollsRunning is returned
+func (s *Scheduler) Drain(ctx context.Context) error {
+	s.Stop()
+	done := make(chan int)
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancelPolls()
+	}
+	select {
+	case <-done:
+	case <-time.After(drainCancelWait):
+		logger.Warnf("polls still running %s after being cancelled, not waiting for them", drainCancelWait)
+		return ErrPollsRunning
+	}
+	return ctx.Err()
+}
+
+// FlushRounds closes the rounds not closed yet, including the current one,
+// without waiting for their end. it is meant to be called after Drain so
+// that the samples of the last, partial, round are not lost on shutdown
+func (s *Scheduler) FlushRounds() {
+	now := time.Now()
+	s.Lock()
+	first := s.nextRound
+	s.Unlock()
+	for id := first; id <= roundID(now, s.Period); id++ {
+		s.closeRound(id, now)
+	}
+}
@@ -64,8 +64,106 @@ type UwsgiStats struct {
 		Tx            int    `json:"tx"`
 		Vsz           int    `json:"vsz"`
 	} `json:"workers"`
+
+	// Target is the discovered address the stats were polled from and the
+	// stable identity of the host, Labels are the ones attached to it at
+	// discovery time
+	Target string            `json:"-"`
+	Labels map[string]string `json:"-"`
+	// MasterRestarted is set when the uwsgi master pid changed since the
+	// previous poll of the same target, all the uwsgi counters were reset
+	MasterRestarted bool `json:"-"`
+	// Round is the collection round the stats were polled for, Generation
+	// the one of the poller that polled them
+	Round      int64 `json:"-"`
+	Generation int64 `json:"-"`
+
+	// Changes holds the worker kills and respawns detected by the poller
+	// against the previous poll of the same host
+	Changes []*WorkerChange `json:"-"`
+}
+
+// WorkerChange describes what happened to a single worker between two
+// consecutive polls
+type WorkerChange struct {
+	WorkerID  int
+	OldPid    int
+	NewPid    int
+	Harakiris int
+	Respawns  int
 }
 
+// DiffWorkers compares two consecutive polls of the same host and returns
+// the workers that were hit by harakiri or respawned in between. a change of
+// the master pid means the counters were reset, in that case nothing can be
+// compared and no change is reported
+func DiffWorkers(prev, cur *UwsgiStats) (changes []*WorkerChange) {
+	if prev == nil || cur == nil || prev.Pid != cur.Pid {
+		return nil
+	}
+	previous := make(map[int]int)
+	for i, wk := range prev.Workers {
+		previous[wk.ID] = i
+	}
+	for _, wk := range cur.Workers {
+		i, ok := previous[wk.ID]
+		if !ok {
+			continue
+		}
+		old := prev.Workers[i]
+		change := &WorkerChange{
+			WorkerID: wk.ID,
+			OldPid:   old.Pid,
+			NewPid:   wk.Pid,
+		}
+		if wk.HarakiriCount > old.HarakiriCount {
+			change.Harakiris = wk.HarakiriCount - old.HarakiriCount
+		}
+		if wk.RespawnCount > old.RespawnCount {
+			change.Respawns = wk.RespawnCount - old.RespawnCount
+		} else if wk.Pid != old.Pid || wk.LastSpawn != old.LastSpawn {
+			// the worker was replaced but the counter did not move, count
+			// it at least once
+			change.Respawns = 1
+		}
+		if change.Harakiris > 0 || change.Respawns > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// AppStats holds the counters of a single mounted application, summed
+// across all the workers that serve it
+type AppStats struct {
+	ID          int
+	Mountpoint  string
+	Requests    float64
+	Exceptions  float64
+	StartupTime float64
+}
+
+// AppName returns the name used to identify an application: its mountpoint
+// or, for the default app that has none, its uwsgi app id
+func AppName(mountpoint string, id int) string {
+	if mountpoint != "" {
+		return mountpoint
+	}
+	return fmt.Sprintf("app-%d", id)
+}
+
+// ID returns the key the host state is tracked with: the discovered target
+// address, which survives restarts of the uwsgi master, or the uwsgi reported
+// identity when the stats were not obtained through a poller
+func (s *UwsgiStats) ID() string {
+	if s.Target != "" {
+		return s.Target
+	}
+	return s.UniqueID()
+}
+
+// UniqueID returns the identity reported by uwsgi itself. it changes every
+// time the master restarts so it is only kept as metadata
 func (s *UwsgiStats) UniqueID() string {
 	socket_name := "_sockname_"
 	for _, socket := range s.Sockets {
@@ -92,40 +190,184 @@ func (s *UwsgiStats) ExceptionsCount() (n float64) {
 	return n
 }
 
+// StatusCounts returns the number of workers in each status reported by uwsgi
+func (s *UwsgiStats) StatusCounts() map[string]float64 {
+	counts := make(map[string]float64)
+	for _, wk := range s.Workers {
+		counts[wk.Status] += 1.0
+	}
+	return counts
+}
+
+// ActiveWorkers returns the spawned workers that are not in an inactive
+// status, e.g. not shut down by the cheaper subsystem
+func (s *UwsgiStats) ActiveWorkers() (n float64) {
+	for _, wk := range s.Workers {
+		if classifier.IsActive(wk.Status) {
+			n += 1.0
+		}
+	}
+	return n
+}
+
+// BusyWorkers returns the active workers that are not available for new
+// requests
 func (s *UwsgiStats) BusyWorkers() (n float64) {
 	for _, wk := range s.Workers {
-		if wk.Status == "busy" {
+		if classifier.IsBusy(wk.Status) {
 			n += 1.0
 		}
 	}
 	return n
 }
 
+// IdleWorkers returns the workers in a status counting as available capacity
 func (s *UwsgiStats) IdleWorkers() (n float64) {
 	for _, wk := range s.Workers {
-		if wk.Status == "idle" {
+		if classifier.IsAvailable(wk.Status) {
 			n += 1.0
 		}
 	}
 	return n
 }
 
+// TotalCores returns the number of cores (async slots or greenlets) of the
+// active workers
+func (s *UwsgiStats) TotalCores() (n float64) {
+	for _, wk := range s.Workers {
+		if classifier.IsActive(wk.Status) {
+			n += float64(len(wk.Cores))
+		}
+	}
+	return n
+}
+
+// BusyCores returns the cores of the active workers currently serving a
+// request
+func (s *UwsgiStats) BusyCores() (n float64) {
+	for _, wk := range s.Workers {
+		if !classifier.IsActive(wk.Status) {
+			continue
+		}
+		for _, core := range wk.Cores {
+			if core.InRequest != 0 {
+				n += 1.0
+			}
+		}
+	}
+	return n
+}
+
+func (s *UwsgiStats) IdleCores() (n float64) {
+	return s.TotalCores() - s.BusyCores()
+}
+
+func (s *UwsgiStats) BusyCoresPercentage() (n float64) {
+	total_cores := s.TotalCores()
+	if total_cores == 0 {
+		return 0.0
+	}
+	return (s.BusyCores() * 100.0) / total_cores
+}
+
+func (s *UwsgiStats) IdleCoresPercentage() (n float64) {
+	total_cores := s.TotalCores()
+	if total_cores == 0 {
+		return 0.0
+	}
+	return (s.IdleCores() * 100.0) / total_cores
+}
+
+// MultiCore reports whether the host runs more than one core per worker, as
+// in async or gevent mode
+func (s *UwsgiStats) MultiCore() bool {
+	for _, wk := range s.Workers {
+		if len(wk.Cores) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Saturation returns the busy and total capacity of the host: cores when it
+// runs more than one core per worker, since a busy worker may still have
+// free cores, and active workers otherwise
+func (s *UwsgiStats) Saturation() (busy, capacity float64) {
+	if s.MultiCore() {
+		return s.BusyCores(), s.TotalCores()
+	}
+	return s.BusyWorkers(), s.ActiveWorkers()
+}
+
+func (s *UwsgiStats) SaturationPercentage() (n float64) {
+	busy, capacity := s.Saturation()
+	if capacity == 0 {
+		return 0.0
+	}
+	return (busy * 100.0) / capacity
+}
+
+// Harakiris returns the number of harakiri detected since the previous poll
+func (s *UwsgiStats) Harakiris() (n float64) {
+	for _, change := range s.Changes {
+		n += float64(change.Harakiris)
+	}
+	return n
+}
+
+// Respawns returns the number of worker respawns detected since the previous
+// poll
+func (s *UwsgiStats) Respawns() (n float64) {
+	for _, change := range s.Changes {
+		n += float64(change.Respawns)
+	}
+	return n
+}
+
+// BusyWorkersPercentage is computed against the active workers, so that
+// together with IdleWorkersPercentage it adds up to 100 even when the cheaper
+// subsystem has shut some workers down
 func (s *UwsgiStats) BusyWorkersPercentage() (n float64) {
-	total_workers := s.TotalWorkers()
-	if total_workers == 0 {
+	active_workers := s.ActiveWorkers()
+	if active_workers == 0 {
 		return 0.0
 	}
 	busy_workers := s.BusyWorkers()
-	return (busy_workers * 100.0) / total_workers
+	return (busy_workers * 100.0) / active_workers
 }
 
 func (s *UwsgiStats) IdleWorkersPercentage() (n float64) {
-	total_workers := s.TotalWorkers()
-	if total_workers == 0 {
+	active_workers := s.ActiveWorkers()
+	if active_workers == 0 {
 		return 0.0
 	}
 	idle_workers := s.IdleWorkers()
-	return (idle_workers * 100.0) / total_workers
+	return (idle_workers * 100.0) / active_workers
+}
+
+// Apps aggregates the per-worker application counters by app name. requests
+// and exceptions are summed, startup time is the slowest seen on any worker
+func (s *UwsgiStats) Apps() map[string]*AppStats {
+	apps := make(map[string]*AppStats)
+	for _, wk := range s.Workers {
+		for _, app := range wk.Apps {
+			name := AppName(app.Mountpoint, app.ID)
+			a, ok := apps[name]
+			if !ok {
+				a = &AppStats{
+					ID:         app.ID,
+					Mountpoint: app.Mountpoint,
+				}
+				apps[name] = a
+			}
+			a.Requests += float64(app.Requests)
+			a.Exceptions += float64(app.Exceptions)
+			if startup := float64(app.StartupTime); startup > a.StartupTime {
+				a.StartupTime = startup
+			}
+		}
+	}
+	return apps
 }
 
 func (s *UwsgiStats) String() string {
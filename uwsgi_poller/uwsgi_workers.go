@@ -0,0 +1,71 @@
+package uwsgi_poller
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// DefaultAvailableStates are the worker statuses that count as spare
+	// capacity unless configured otherwise
+	DefaultAvailableStates = []string{"idle", "accepting"}
+	// DefaultInactiveStates are the worker statuses that do not count as
+	// active workers unless configured otherwise. cheap workers are the ones
+	// shut down by the cheaper subsystem
+	DefaultInactiveStates = []string{"cheap", "pause"}
+
+	classifier = mustWorkerClassifier(DefaultAvailableStates, DefaultInactiveStates)
+)
+
+// WorkerClassifier decides how the worker statuses reported by uwsgi count
+// towards capacity: a worker in an available status is spare capacity, a
+// worker in an inactive status is not an active worker at all and every
+// other status is considered busy
+type WorkerClassifier struct {
+	available map[string]bool
+	inactive  map[string]bool
+}
+
+func NewWorkerClassifier(available, inactive []string) (w *WorkerClassifier, err error) {
+	w = &WorkerClassifier{
+		available: make(map[string]bool),
+		inactive:  make(map[string]bool),
+	}
+	for _, status := range available {
+		w.available[strings.ToLower(status)] = true
+	}
+	for _, status := range inactive {
+		status = strings.ToLower(status)
+		if w.available[status] {
+			return nil, fmt.Errorf("worker status %s cannot be both available and inactive", status)
+		}
+		w.inactive[status] = true
+	}
+	return w, nil
+}
+
+func mustWorkerClassifier(available, inactive []string) *WorkerClassifier {
+	w, err := NewWorkerClassifier(available, inactive)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+// SetWorkerClassifier replaces the classifier used by all the UwsgiStats
+// worker metrics. it is meant to be called once at startup
+func SetWorkerClassifier(w *WorkerClassifier) {
+	classifier = w
+}
+
+func (w *WorkerClassifier) IsAvailable(status string) bool {
+	return w.available[strings.ToLower(status)]
+}
+
+func (w *WorkerClassifier) IsActive(status string) bool {
+	return !w.inactive[strings.ToLower(status)]
+}
+
+func (w *WorkerClassifier) IsBusy(status string) bool {
+	return w.IsActive(status) && !w.IsAvailable(status)
+}